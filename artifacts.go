@@ -1,23 +1,33 @@
 package artifacts
 
 import (
+	"bufio"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"sync"
 
 	artifactFS "github.com/flanksource/artifacts/fs"
 	"github.com/flanksource/duty/context"
 	"github.com/flanksource/duty/models"
 	"github.com/gabriel-vasile/mimetype"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 // MIMEWriter implements io.Writer with a limit on the number of bytes used for detection.
 type MIMEWriter struct {
 	buffer []byte
 
-	Max int // max number of bytes to use from the source
+	Max  int    // max number of bytes to use from the source
+	Path string // Optional: path of the source, used to refine the detected type by its extension
 }
 
 func (t *MIMEWriter) Write(bb []byte) (n int, err error) {
@@ -33,10 +43,16 @@ func (t *MIMEWriter) Write(bb []byte) (n int, err error) {
 	return rem, nil
 }
 
+// Detect returns the type detected from the magic bytes only.
 func (t *MIMEWriter) Detect() *mimetype.MIME {
 	return mimetype.Detect(t.buffer)
 }
 
+// ContentType returns the type detected from the magic bytes, refined by the extension of Path.
+func (t *MIMEWriter) ContentType() string {
+	return DetectContentType(t.Path, t.buffer)
+}
+
 // readerWithLength wraps an io.Reader and carries content length information
 type readerWithLength struct {
 	reader io.Reader
@@ -91,37 +107,323 @@ type Artifact struct {
 	Path          string
 	Content       io.ReadCloser
 	ContentLength int64 // Optional: content length if known, -1 if unknown
+
+	// Optional: template the artifact is placed by, e.g. {{.date}}/{{.check_id}}/{{.uuid}}-{{.filename}}.
+	// Path then only provides the filename, and a numeric suffix is added if the rendered path is taken.
+	// Templates using {{.sha256}} instead deduplicate: when an artifact of the connection is stored at
+	// the rendered path, the content is not written again and the artifact's row points at the stored blob.
+	// See DateShardedPathTemplate and ContentAddressedPathTemplate for built-in layouts.
+	PathTemplate string
+
+	// Optional: what happens when something is already stored at Path. Defaults to overwriting it,
+	// or to artifactFS.WriteRenameWithSuffix when PathTemplate is set.
+	// The version for artifactFS.WriteIfMatch is passed with artifactFS.WithWriteOptions.
+	WriteMode artifactFS.WriteMode
+
+	// Optional: compression applied when the content type is compressible (see CompressibleContentTypes)
+	Compression Compression
+
+	// Optional: additional checksums computed while the artifact is streamed and recorded in its Metadata.
+	// A SHA-256 checksum is always computed. When CRC32C or SHA-256 is requested, the storage backend
+	// is asked to validate the upload with it where supported.
+	Checksums []ChecksumAlgorithm
+
+	// Optional: rejects the artifact before it is stored if its content type is not allowed.
+	// Both the given ContentType and the type detected from the content are checked.
+	ContentTypePolicy *ContentTypePolicy
+
+	// Optional: scans text artifacts for secrets before they are stored, masking them or rejecting the artifact.
+	// The number of masked secrets is recorded in the artifact's Metadata and the checksum covers the masked content.
+	Redaction *RedactionPolicy
+
+	// Optional: maximum size of the content in bytes. Larger artifacts fail with ArtifactTooLargeError.
+	MaxSize int64
+
+	// Optional: byte quotas enforced against the artifacts already stored. Exceeding one fails with QuotaExceededError.
+	Quota *Quota
+
+	// Optional: labels such as the check name, playbook run, environment or severity.
+	// They are recorded in the artifact's Metadata, stored as object metadata on S3 and GCS,
+	// and in the artifact_labels table (see MigrateArtifactLabels) to be filtered on with ListArtifacts.
+	// Invalid labels fail with InvalidLabelError.
+	Labels map[string]string
+
+	// Optional: called as the artifact is stored, with the number of bytes stored so far
+	// and the total if known. The stored size differs from the content's when it is compressed or encrypted.
+	Progress artifactFS.ProgressFunc
+
+	// Optional: throttles storing the artifact, see artifactFS.NewBandwidthLimiter.
+	Limiter *rate.Limiter
+
+	// Optional: signs the SHA-256 digest of the content. The signature is recorded in the artifact's Metadata
+	// and can be checked with VerifyArtifact.
+	Signer Signer
+
+	// Optional: encrypts the artifact and its metadata client-side with per-artifact data keys.
+	// The artifact must be read back through artifactFS.NewEncryptedFS with the same key provider.
+	KeyProvider artifactFS.KeyProvider
 }
 
 const maxBytesForMimeDetection = 512 * 1024 // 512KB
 
+// byteCounter is an io.Writer that counts the bytes written to it.
+type byteCounter struct {
+	n int64
+}
+
+func (t *byteCounter) Write(bb []byte) (int, error) {
+	t.n += int64(len(bb))
+	return len(bb), nil
+}
+
+// SaveArtifact writes the artifact content to the filesystem and records it in the artifacts table.
+//
+// The save is all-or-nothing for new paths: if the write fails part way, or the row cannot be inserted,
+// the blob this save created is deleted again. A blob already stored at the path is never deleted, as it
+// belongs to another artifact: a failed overwrite keeps it on S3, GCS and local filesystems,
+// and a failure after a successful overwrite leaves the new content in place.
+// When ctx carries a transaction the insert runs in a savepoint so that a failed save does not abort
+// the caller's transaction. Rolling back the caller's transaction afterwards does not remove the blob.
+//
+// Compressed artifacts keep the content type and checksum of the original content;
+// their size is the compressed size and the encoding is recorded in the artifact's Metadata.
 func SaveArtifact(ctx context.Context, fs artifactFS.FilesystemRW, artifact *models.Artifact, data Artifact) error {
+	ctx, span := ctx.StartSpan("SaveArtifact")
+	defer span.End()
+
+	created, err := storeArtifact(ctx, fs, artifact, data, noLock{})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	span.SetAttributes(attribute.String("artifact.path", artifact.Path), attribute.Int64("artifact.size", artifact.Size))
+
+	err = ctx.Transaction(func(ctx context.Context, span trace.Span) error {
+		span.SetAttributes(attribute.String("artifact.path", artifact.Path))
+		if err := ctx.DB().Create(artifact).Error; err != nil {
+			return err
+		}
+		return createLabels(ctx, artifact.ID, data.Labels)
+	})
+	if err != nil {
+		err = cleanupBlob(ctx, fs, artifact.Path, created, fmt.Errorf("error saving artifact to db: %w", err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// storeArtifact writes the artifact's blob and metadata and fills in its row, without inserting it,
+// and reports whether the blob was created by this save rather than overwriting an existing one.
+// Nothing this save created is left behind on the filesystem when it fails.
+//
+// When the content is already stored by an artifact at its content-addressed path, nothing is written:
+// the blob of the row is filled in from that artifact, and the rest of the row is kept.
+// The database is queried while holding queries, which serializes concurrent saves sharing ctx.
+func storeArtifact(ctx context.Context, fs artifactFS.FilesystemRW, artifact *models.Artifact, data Artifact, queries sync.Locker) (created bool, err error) {
 	defer func() { _ = data.Content.Close() }()
 
+	if err := validateLabels(data.Labels); err != nil {
+		return false, err
+	}
+
+	if data.KeyProvider != nil {
+		fs = artifactFS.NewEncryptedFS(fs, data.KeyProvider)
+	}
+
 	// Determine content length if not already provided
 	if data.ContentLength < 0 {
 		data.ContentLength = determineContentLength(data.Content)
 	}
 
+	queries.Lock()
+	limits, err := sizeLimits(ctx, artifact, data)
+	queries.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	if data.PathTemplate != "" {
+		renderedPath, existing, err := renderArtifactPath(ctx, fs, artifact, &data, limits, queries)
+		if err != nil {
+			return false, err
+		}
+		if existing != nil {
+			artifact.Path = existing.Path
+			artifact.Filename = existing.Filename
+			artifact.Size = existing.Size
+			artifact.ContentType = existing.ContentType
+			artifact.Checksum = existing.Checksum
+			return false, nil
+		}
+		data.Path = renderedPath
+	}
+
+	var source io.Reader = data.Content
+	if limits := contentLimits(limits, data); len(limits) > 0 {
+		source = &limitReader{reader: data.Content, limits: limits}
+	}
+
+	// The content type is detected upfront as it decides how the content is stored
+	_, detectSpan := ctx.StartSpan("DetectContentType")
+	content := bufio.NewReaderSize(source, maxBytesForMimeDetection)
+	header, err := content.Peek(maxBytesForMimeDetection)
+	if err != nil && !errors.Is(err, io.EOF) {
+		detectSpan.RecordError(err)
+		detectSpan.End()
+		return false, fmt.Errorf("error reading artifact(%s): %w", data.Path, err)
+	}
+
+	detectedContentType := DetectContentType(data.Path, header)
+	detectSpan.SetAttributes(attribute.String("artifact.content_type", detectedContentType))
+	detectSpan.End()
+	if data.ContentType == "" {
+		data.ContentType = detectedContentType
+	}
+
+	if data.ContentTypePolicy != nil {
+		for _, contentType := range []string{data.ContentType, detectedContentType} {
+			if !data.ContentTypePolicy.Allows(contentType) {
+				return false, &ContentTypeNotAllowedError{Path: data.Path, ContentType: contentType}
+			}
+		}
+	}
+
+	var plaintext io.Reader = content
+	contentLength := data.ContentLength
+
+	var redactor *redactReader
+	if data.Redaction != nil && data.Redaction.applies(data.ContentType) {
+		redactor = newRedactReader(content, data.Path, *data.Redaction)
+		plaintext = redactor
+		contentLength = -1 // masking changes the length
+	}
+
 	checksum := sha256.New()
-	mimeReader := io.TeeReader(data.Content, checksum)
+	size := &byteCounter{}
+	checksums, err := newChecksums(data.Checksums)
+	if err != nil {
+		return false, err
+	}
 
-	mimeWriter := &MIMEWriter{Max: maxBytesForMimeDetection}
-	fileReader := io.TeeReader(mimeReader, mimeWriter)
+	hashWriters := []io.Writer{checksum, size}
+	for _, h := range checksums {
+		hashWriters = append(hashWriters, h)
+	}
+
+	var fileReader io.Reader = io.TeeReader(plaintext, io.MultiWriter(hashWriters...))
+
+	var metadata Metadata
+	if data.Compression != "" && IsCompressible(data.ContentType) {
+		compressed, err := compress(fileReader, data.Compression)
+		if err != nil {
+			return false, fmt.Errorf("error compressing artifact(%s): %w", data.Path, err)
+		}
+		defer func() { _ = compressed.Close() }()
+
+		fileReader = compressed
+		contentLength = -1
+		metadata.ContentEncoding = string(data.Compression)
+	}
+
+	if limits := storedLimits(limits); len(limits) > 0 {
+		fileReader = &limitReader{reader: fileReader, limits: limits}
+	}
 
 	// Create a reader wrapper that carries the content length
 	wrappedReader := &readerWithLength{
 		reader: fileReader,
-		length: data.ContentLength,
+		length: contentLength,
+	}
+
+	writeOptions := artifactFS.GetWriteOptions(ctx)
+	writeOptions.ChecksumAlgorithm = backendChecksumAlgorithm(data.Checksums)
+	if data.Progress != nil {
+		writeOptions.Progress = data.Progress
+	}
+	if data.Limiter != nil {
+		writeOptions.Limiter = data.Limiter
+	}
+	if data.WriteMode != "" {
+		writeOptions.Mode = data.WriteMode
+	} else if data.PathTemplate != "" && writeOptions.Mode == "" {
+		writeOptions.Mode = artifactFS.WriteRenameWithSuffix
+	}
+	if data.KeyProvider == nil {
+		// object metadata is stored in plaintext, so labels of encrypted artifacts are only kept in the sidecar
+		writeOptions.Metadata = data.Labels
+	}
+
+	switch writeOptions.Mode {
+	case artifactFS.WriteFailIfExists, artifactFS.WriteRenameWithSuffix:
+		// a failed write removes what it created, and the path is only known once written
+		created = true
+	default:
+		// only a path this save creates may be cleaned up: an existing blob belongs to another artifact
+		_, statErr := fs.Stat(data.Path)
+		created = errors.Is(statErr, os.ErrNotExist)
 	}
 
-	info, err := fs.Write(ctx, data.Path, wrappedReader)
+	uploadCtx, uploadSpan := ctx.StartSpan("UploadArtifact")
+	info, err := fs.Write(artifactFS.WithWriteOptions(uploadCtx, writeOptions), data.Path, wrappedReader)
+	if err != nil {
+		uploadSpan.RecordError(err)
+	} else {
+		uploadSpan.SetAttributes(attribute.Int64("artifact.bytes", info.Size()))
+	}
+	uploadSpan.End()
 	if err != nil {
-		return fmt.Errorf("error writing artifact(%s): %w", data.Path, err)
+		err = fmt.Errorf("error writing artifact(%s): %w", data.Path, err)
+		if writeOptions.Mode == artifactFS.WriteFailIfExists || writeOptions.Mode == artifactFS.WriteRenameWithSuffix {
+			return false, err
+		}
+		return false, cleanupBlob(ctx, fs, data.Path, created, err)
 	}
 
-	if data.ContentType == "" {
-		data.ContentType = mimeWriter.Detect().String()
+	if writeOptions.Mode == artifactFS.WriteRenameWithSuffix {
+		data.Path = path.Join(path.Dir(data.Path), path.Base(info.Name()))
+	}
+
+	// client-side encryption adds to the size of the content streamed
+	if err := checkStoredSize(limits, info.Size()); err != nil {
+		return false, cleanupBlob(ctx, fs, data.Path, created, err)
+	}
+
+	if metadata.ContentEncoding != "" {
+		metadata.Size = size.n
+	}
+
+	if len(data.Labels) > 0 {
+		metadata.Labels = data.Labels
+	}
+
+	if redactor != nil {
+		metadata.Redactions = redactor.Redactions()
+	}
+
+	if data.Signer != nil {
+		signature, err := data.Signer.Sign(checksum.Sum(nil))
+		if err != nil {
+			return false, cleanupBlob(ctx, fs, data.Path, created, fmt.Errorf("error signing artifact(%s): %w", data.Path, err))
+		}
+		metadata.Signature = base64.StdEncoding.EncodeToString(signature)
+		metadata.SignatureKeyID = data.Signer.KeyID()
+	}
+
+	if len(checksums) > 0 {
+		metadata.Checksums = make(map[ChecksumAlgorithm]string, len(checksums))
+		for algorithm, h := range checksums {
+			metadata.Checksums[algorithm] = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+
+	if !metadata.IsEmpty() {
+		if err := writeMetadata(ctx, fs, data.Path, metadata); err != nil {
+			return false, cleanupBlob(ctx, fs, data.Path, created, fmt.Errorf("error writing metadata of artifact(%s): %w", data.Path, err))
+		}
 	}
 
 	artifact.Path = data.Path
@@ -129,9 +431,51 @@ func SaveArtifact(ctx context.Context, fs artifactFS.FilesystemRW, artifact *mod
 	artifact.Size = info.Size()
 	artifact.ContentType = data.ContentType
 	artifact.Checksum = hex.EncodeToString(checksum.Sum(nil))
-	if err := ctx.DB().Create(&artifact).Error; err != nil {
-		return fmt.Errorf("error saving artifact to db: %w", err)
+	return created, nil
+}
+
+// ReadArtifact opens the content of a saved artifact, undoing any compression applied by SaveArtifact.
+// Encrypted artifacts are decrypted when fs is an encrypted filesystem.
+func ReadArtifact(ctx context.Context, fs artifactFS.FilesystemRW, artifact *models.Artifact) (io.ReadCloser, error) {
+	metadata, err := ReadMetadata(ctx, fs, artifact.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata of artifact(%s): %w", artifact.Path, err)
 	}
 
-	return nil
+	reader, err := fs.Read(ctx, artifact.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading artifact(%s): %w", artifact.Path, err)
+	}
+
+	if metadata.ContentEncoding == "" {
+		return reader, nil
+	}
+
+	decompressed, err := decompress(reader, metadata.ContentEncoding)
+	if err != nil {
+		_ = reader.Close()
+		return nil, fmt.Errorf("error decompressing artifact(%s): %w", artifact.Path, err)
+	}
+
+	return decompressed, nil
+}
+
+// noLock is the sync.Locker of a save that does not share its context with concurrent saves.
+type noLock struct{}
+
+func (noLock) Lock()   {}
+func (noLock) Unlock() {}
+
+// cleanupBlob deletes a partially or fully written blob after a failed save, if the save created it.
+// If the cleanup fails as well, both errors are returned.
+func cleanupBlob(ctx context.Context, fs artifactFS.FilesystemRW, path string, created bool, cause error) error {
+	if !created {
+		return cause
+	}
+
+	if err := deleteBlob(ctx, fs, path); err != nil {
+		return errors.Join(cause, fmt.Errorf("error cleaning up artifact(%s): %w", path, err))
+	}
+
+	return cause
 }
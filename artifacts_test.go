@@ -0,0 +1,105 @@
+package artifacts
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+)
+
+// streamed returns content whose length is unknown upfront.
+func streamed(content string) io.ReadCloser {
+	return io.NopCloser(io.MultiReader(strings.NewReader(content)))
+}
+
+func readContent(t *testing.T, ctx context.Context, fs artifactFS.FilesystemRW, artifact *models.Artifact) string {
+	t.Helper()
+	reader, err := ReadArtifact(ctx, fs, artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestSaveArtifactRollback(t *testing.T) {
+	ctx := newTestContext(t)
+	fs := artifactFS.NewLocalFS(t.TempDir())
+	connectionID := uuid.New()
+
+	existing := &models.Artifact{ConnectionID: connectionID}
+	err := SaveArtifact(ctx, fs, existing, Artifact{
+		Path:          "report.txt",
+		Content:       streamed("the earlier report"),
+		ContentLength: -1,
+		Labels:        map[string]string{"env": "prod"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("failed overwrite keeps the existing blob", func(t *testing.T) {
+		err := SaveArtifact(ctx, fs, &models.Artifact{ConnectionID: connectionID}, Artifact{
+			Path:          "report.txt",
+			Content:       streamed(strings.Repeat("too large ", 100)),
+			ContentLength: -1,
+			MaxSize:       64,
+		})
+		var tooLarge *ArtifactTooLargeError
+		if !errors.As(err, &tooLarge) {
+			t.Fatalf("expected the save to fail with ArtifactTooLargeError, got %v", err)
+		}
+
+		if content := readContent(t, ctx, fs, existing); content != "the earlier report" {
+			t.Errorf("expected the existing blob to be intact, got %q", content)
+		}
+		if metadata, err := ReadMetadata(ctx, fs, existing.Path); err != nil || metadata.Labels["env"] != "prod" {
+			t.Errorf("expected the existing metadata to be intact, got %+v: %v", metadata, err)
+		}
+	})
+
+	t.Run("failed insert removes the created blob", func(t *testing.T) {
+		// the ID is taken, so the insert fails
+		err := SaveArtifact(ctx, fs, &models.Artifact{ID: existing.ID, ConnectionID: connectionID}, Artifact{
+			Path:          "new.txt",
+			Content:       streamed("new content"),
+			ContentLength: -1,
+			Labels:        map[string]string{"env": "prod"},
+		})
+		if err == nil {
+			t.Fatal("expected the insert to fail")
+		}
+
+		for _, p := range []string{"new.txt", metadataPath("new.txt")} {
+			if _, err := fs.Stat(p); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected %s to be removed, got %v", p, err)
+			}
+		}
+	})
+
+	t.Run("failed insert keeps an overwritten blob", func(t *testing.T) {
+		err := SaveArtifact(ctx, fs, &models.Artifact{ID: existing.ID, ConnectionID: connectionID}, Artifact{
+			Path:          "report.txt",
+			Content:       streamed("the later report"),
+			ContentLength: -1,
+		})
+		if err == nil {
+			t.Fatal("expected the insert to fail")
+		}
+
+		if _, err := fs.Stat("report.txt"); err != nil {
+			t.Errorf("expected the blob of the existing artifact to be kept, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package artifacts
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultBatchConcurrency = 4
+
+// ErrBatchAborted is the result of the artifacts of an all-or-nothing batch that were not saved
+// because another artifact of the batch failed.
+var ErrBatchAborted = errors.New("batch aborted")
+
+// BatchArtifact is an artifact row together with the content saved for it.
+type BatchArtifact struct {
+	Artifact *models.Artifact
+	Data     Artifact
+}
+
+type BatchOptions struct {
+	// Concurrency is the number of artifacts uploaded at the same time. Defaults to 4.
+	Concurrency int
+
+	// AllOrNothing saves either every artifact or none of them: once one fails, the remaining uploads
+	// are skipped and the blobs already stored are deleted again.
+	AllOrNothing bool
+}
+
+// BatchResult is the outcome of saving one artifact of a batch.
+type BatchResult struct {
+	Artifact *models.Artifact
+
+	// Err is nil if the artifact was saved.
+	Err error
+
+	// created is set when the blob was created by the batch, and may be deleted again when it is aborted
+	created bool
+}
+
+// SaveArtifacts saves a batch of artifacts like SaveArtifact, uploading them concurrently and
+// inserting all their rows at once.
+//
+// The results are in the order of the batch. The returned error joins the errors of all the artifacts
+// that were not saved.
+//
+// Quotas are checked for every artifact against the artifacts stored before the batch.
+// ctx may carry a transaction: the queries of the concurrent uploads are serialized,
+// and the rows are inserted in a savepoint of it.
+func SaveArtifacts(ctx context.Context, fs artifactFS.FilesystemRW, batch []BatchArtifact, opts BatchOptions) ([]BatchResult, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultBatchConcurrency
+	}
+
+	results := make([]BatchResult, len(batch))
+	var failed atomic.Bool
+	var queries sync.Mutex
+
+	var group errgroup.Group
+	group.SetLimit(concurrency)
+	for i, item := range batch {
+		results[i].Artifact = item.Artifact
+		group.Go(func() error {
+			if opts.AllOrNothing && failed.Load() {
+				_ = item.Data.Content.Close()
+				results[i].Err = ErrBatchAborted
+				return nil
+			}
+
+			created, err := storeArtifact(ctx, fs, item.Artifact, item.Data, &queries)
+			if err != nil {
+				results[i].Err = err
+				failed.Store(true)
+			}
+			results[i].created = created
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	if opts.AllOrNothing && failed.Load() {
+		abortBatch(ctx, fs, results, ErrBatchAborted)
+		return results, batchError(results)
+	}
+
+	var stored []*models.Artifact
+	var labels []map[string]string
+	for i, result := range results {
+		if result.Err == nil {
+			stored = append(stored, result.Artifact)
+			labels = append(labels, batch[i].Data.Labels)
+		}
+	}
+
+	if len(stored) > 0 {
+		err := ctx.Transaction(func(ctx context.Context, _ trace.Span) error {
+			if err := ctx.DB().Create(&stored).Error; err != nil {
+				return err
+			}
+			for i, artifact := range stored {
+				if err := createLabels(ctx, artifact.ID, labels[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			abortBatch(ctx, fs, results, fmt.Errorf("error saving artifacts to db: %w", err))
+		}
+	}
+
+	return results, batchError(results)
+}
+
+// abortBatch deletes the blobs of the stored artifacts of a batch and marks them as failed with cause.
+func abortBatch(ctx context.Context, fs artifactFS.FilesystemRW, results []BatchResult, cause error) {
+	for i, result := range results {
+		if result.Err != nil {
+			continue
+		}
+
+		results[i].Err = cleanupBlob(ctx, fs, result.Artifact.Path, result.created, cause)
+	}
+}
+
+// batchError joins the errors of the artifacts that failed on their own,
+// and of the aborted artifacts whose blob could not be cleaned up.
+func batchError(results []BatchResult) error {
+	var errs []error
+	for _, result := range results {
+		// an abort joined with a cleanup failure is reported, only a bare abort is left out
+		if result.Err != nil && result.Err != ErrBatchAborted {
+			errs = append(errs, result.Err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
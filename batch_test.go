@@ -0,0 +1,86 @@
+package artifacts
+
+import (
+	gocontext "context"
+	"errors"
+	"strings"
+	"testing"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// undeletableFS fails every delete.
+type undeletableFS struct {
+	artifactFS.FilesystemRW
+}
+
+var errDeleteFailed = errors.New("delete failed")
+
+func (t undeletableFS) Delete(ctx gocontext.Context, path string) error {
+	return errDeleteFailed
+}
+
+func TestSaveArtifactsAbortCleanupFailure(t *testing.T) {
+	ctx := newTestContext(t)
+	fs := undeletableFS{artifactFS.NewLocalFS(t.TempDir())}
+	connectionID := uuid.New()
+
+	batch := []BatchArtifact{
+		{Artifact: &models.Artifact{ConnectionID: connectionID}, Data: Artifact{Path: "saved.txt", Content: streamed("saved"), ContentLength: -1}},
+		{Artifact: &models.Artifact{ConnectionID: connectionID}, Data: Artifact{Path: "large.txt", Content: streamed(strings.Repeat("x", 128)), ContentLength: -1, MaxSize: 64}},
+	}
+
+	results, err := SaveArtifacts(ctx, fs, batch, BatchOptions{Concurrency: 1, AllOrNothing: true})
+	if !errors.Is(results[0].Err, ErrBatchAborted) {
+		t.Errorf("expected the first artifact to be aborted, got %v", results[0].Err)
+	}
+	if !errors.Is(err, errDeleteFailed) {
+		t.Errorf("expected the failed cleanup of the aborted artifact to be reported, got %v", err)
+	}
+
+	var tooLarge *ArtifactTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Errorf("expected the failure of the second artifact to be reported, got %v", err)
+	}
+}
+
+func TestSaveArtifactsInTransaction(t *testing.T) {
+	ctx := newTestContext(t)
+	fs := artifactFS.NewLocalFS(t.TempDir())
+	connectionID := uuid.New()
+
+	var batch []BatchArtifact
+	for i := range 8 {
+		batch = append(batch, BatchArtifact{
+			Artifact: &models.Artifact{ConnectionID: connectionID},
+			Data: Artifact{
+				Path:          "report.txt",
+				PathTemplate:  ContentAddressedPathTemplate,
+				Content:       streamed(strings.Repeat("r", i+1)),
+				ContentLength: -1,
+				Quota:         &Quota{ConnectionBytes: 1024},
+				Labels:        map[string]string{"batch": "nightly"},
+			},
+		})
+	}
+
+	err := ctx.Transaction(func(ctx context.Context, _ trace.Span) error {
+		_, err := SaveArtifacts(ctx, fs, batch, BatchOptions{Concurrency: 4})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	artifacts, err := ListArtifacts(ctx, ArtifactQuery{ConnectionID: connectionID, Labels: map[string]string{"batch": "nightly"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts) != len(batch) {
+		t.Errorf("expected %d artifacts, got %d", len(batch), len(artifacts))
+	}
+}
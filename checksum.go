@@ -0,0 +1,63 @@
+package artifacts
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"slices"
+	"strings"
+
+	"github.com/zeebo/blake3"
+)
+
+type ChecksumAlgorithm string
+
+const (
+	ChecksumMD5    ChecksumAlgorithm = "md5"
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+	ChecksumCRC32C ChecksumAlgorithm = "crc32c"
+	ChecksumBLAKE3 ChecksumAlgorithm = "blake3"
+)
+
+func newChecksum(algorithm ChecksumAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	case ChecksumBLAKE3:
+		return blake3.New(), nil
+	}
+
+	return nil, fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+}
+
+// newChecksums creates a hash for every requested algorithm.
+func newChecksums(algorithms []ChecksumAlgorithm) (map[ChecksumAlgorithm]hash.Hash, error) {
+	hashes := make(map[ChecksumAlgorithm]hash.Hash, len(algorithms))
+	for _, algorithm := range algorithms {
+		h, err := newChecksum(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		hashes[algorithm] = h
+	}
+
+	return hashes, nil
+}
+
+// backendChecksumAlgorithm picks the checksum the storage backend validates the upload with.
+// CRC32C is supported by both S3 and GCS, SHA-256 by S3 only.
+func backendChecksumAlgorithm(algorithms []ChecksumAlgorithm) string {
+	for _, preferred := range []ChecksumAlgorithm{ChecksumCRC32C, ChecksumSHA256} {
+		if slices.Contains(algorithms, preferred) {
+			return strings.ToUpper(string(preferred))
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,66 @@
+package artifacts
+
+import (
+	"testing"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+)
+
+func TestChecksums(t *testing.T) {
+	ctx := newTestContext(t)
+	fs := artifactFS.NewLocalFS(t.TempDir())
+
+	// the digests of "hello world"
+	tests := []struct {
+		algorithm ChecksumAlgorithm
+		digest    string
+	}{
+		{algorithm: ChecksumMD5, digest: "5eb63bbbe01eeed093cb22bb8f5acdc3"},
+		{algorithm: ChecksumSHA256, digest: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"},
+		{algorithm: ChecksumCRC32C, digest: "c99465aa"},
+		{algorithm: ChecksumBLAKE3, digest: "d74981efa70a0c880b8d8c1985d075dbcbf679b99a5f9914e5aaf96b831a9e24"},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.algorithm), func(t *testing.T) {
+			path := string(test.algorithm) + ".txt"
+			err := SaveArtifact(ctx, fs, &models.Artifact{ConnectionID: uuid.New()}, Artifact{
+				Path:          path,
+				Content:       streamed("hello world"),
+				ContentLength: -1,
+				Checksums:     []ChecksumAlgorithm{test.algorithm},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			metadata, err := ReadMetadata(ctx, fs, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if digest := metadata.Checksums[test.algorithm]; digest != test.digest {
+				t.Errorf("expected the %s digest %s, got %s", test.algorithm, test.digest, digest)
+			}
+		})
+	}
+}
+
+func TestBackendChecksumAlgorithm(t *testing.T) {
+	tests := []struct {
+		algorithms []ChecksumAlgorithm
+		expected   string
+	}{
+		{algorithms: []ChecksumAlgorithm{ChecksumSHA256, ChecksumCRC32C}, expected: "CRC32C"},
+		{algorithms: []ChecksumAlgorithm{ChecksumMD5, ChecksumSHA256}, expected: "SHA256"},
+		{algorithms: []ChecksumAlgorithm{ChecksumMD5, ChecksumBLAKE3}, expected: ""},
+		{expected: ""},
+	}
+
+	for _, test := range tests {
+		if algorithm := backendChecksumAlgorithm(test.algorithms); algorithm != test.expected {
+			t.Errorf("expected %v to be validated with %q, got %q", test.algorithms, test.expected, algorithm)
+		}
+	}
+}
@@ -14,6 +14,14 @@ import (
 
 type S3FileInfo struct {
 	Object types.Object
+
+	// Server-side encryption of the object, only reported by Stat
+	SSEAlgorithm         string
+	SSEKMSKeyID          string
+	SSECustomerAlgorithm string
+
+	// User-defined metadata of the object, only reported by Stat
+	Metadata map[string]string
 }
 
 func (obj S3FileInfo) Name() string {
@@ -36,6 +44,11 @@ func (obj S3FileInfo) FullPath() string {
 	return *obj.Object.Key
 }
 
+// Key returns the key of the object. The file info returned by Stat only has its base name.
+func (obj S3FileInfo) Key() string {
+	return *obj.Object.Key
+}
+
 func (obj S3FileInfo) IsDir() bool {
 	return strings.HasSuffix(obj.Name(), "/")
 }
@@ -43,3 +56,19 @@ func (obj S3FileInfo) IsDir() bool {
 func (obj S3FileInfo) Sys() interface{} {
 	return obj.Object
 }
+
+func (obj S3FileInfo) ServerSideEncryption() (string, string) {
+	if obj.SSECustomerAlgorithm != "" {
+		return "SSE-C", ""
+	}
+
+	return obj.SSEAlgorithm, obj.SSEKMSKeyID
+}
+
+func (obj S3FileInfo) UserMetadata() map[string]string {
+	return obj.Metadata
+}
+
+func (obj S3FileInfo) Version() string {
+	return lo.FromPtr(obj.Object.ETag)
+}
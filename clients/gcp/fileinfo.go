@@ -2,6 +2,7 @@ package gcp
 
 import (
 	"io/fs"
+	"strconv"
 	"time"
 
 	gcs "cloud.google.com/go/storage"
@@ -38,3 +39,28 @@ func (obj GCSFileInfo) Sys() interface{} {
 func (obj GCSFileInfo) FullPath() string {
 	return obj.Object.Name
 }
+
+// Key returns the full name of the object.
+func (obj GCSFileInfo) Key() string {
+	return obj.Object.Name
+}
+
+func (obj GCSFileInfo) ServerSideEncryption() (string, string) {
+	if obj.Object.CustomerKeySHA256 != "" {
+		return "CSEK", ""
+	}
+
+	if obj.Object.KMSKeyName != "" {
+		return "CMEK", obj.Object.KMSKeyName
+	}
+
+	return "", ""
+}
+
+func (obj GCSFileInfo) UserMetadata() map[string]string {
+	return obj.Object.Metadata
+}
+
+func (obj GCSFileInfo) Version() string {
+	return strconv.FormatInt(obj.Object.Generation, 10)
+}
@@ -1,28 +1,91 @@
 package sftp
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
+// Client is an SFTP client together with the SSH connection it runs over.
+type Client struct {
+	*sftp.Client
+	SSH *ssh.Client
+}
+
+// Close closes the SFTP session and its SSH connection.
+func (c *Client) Close() error {
+	return errors.Join(c.Client.Close(), c.SSH.Close())
+}
+
+// Keepalive sends an SSH keepalive request and waits for the server's reply.
+func (c *Client) Keepalive() error {
+	_, _, err := c.SSH.SendRequest("keepalive@openssh.com", true, nil)
+	return err
+}
+
 func SSHConnect(host, user, password string) (*sftp.Client, error) {
+	client, err := Connect(host, user, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Client, nil
+}
+
+// AuthenticationError is returned by Connect when the server rejected the credentials.
+type AuthenticationError struct {
+	Err error
+}
+
+func (e *AuthenticationError) Error() string {
+	return fmt.Sprintf("authentication failed: %v", e.Err)
+}
+
+func (e *AuthenticationError) Unwrap() error {
+	return e.Err
+}
+
+// Connect opens an SFTP session and keeps hold of its SSH connection.
+func Connect(host, user, password string) (*Client, error) {
+	// the password is only asked for once the handshake reached authentication
+	var offered bool
 	config := &ssh.ClientConfig{
 		User: user,
 		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
+			ssh.PasswordCallback(func() (string, error) {
+				offered = true
+				return password, nil
+			}),
 		},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 
-	conn, err := ssh.Dial("tcp", host, config)
+	netConn, err := net.DialTimeout("tcp", host, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	sshConn, channels, requests, err := ssh.NewClientConn(netConn, host, config)
 	if err != nil {
+		_ = netConn.Close()
+
+		var netErr net.Error
+		if offered && !errors.Is(err, io.EOF) && !errors.As(err, &netErr) {
+			return nil, &AuthenticationError{Err: err}
+		}
 		return nil, err
 	}
+	conn := ssh.NewClient(sshConn, channels, requests)
 
 	client, err := sftp.NewClient(conn)
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 
-	return client, nil
+	return &Client{Client: client, SSH: conn}, nil
 }
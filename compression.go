@@ -0,0 +1,114 @@
+package artifacts
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// CompressibleContentTypes are the content types SaveArtifact compresses.
+// Entries are matched with path.Match, so "text/*" matches every text type.
+var CompressibleContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/x-ndjson",
+	"application/xml",
+	"application/*+xml",
+	"application/yaml",
+	"application/x-yaml",
+	"application/javascript",
+	"application/x-sh",
+	"image/svg+xml",
+}
+
+// IsCompressible reports whether content of the given type benefits from compression.
+func IsCompressible(contentType string) bool {
+	return matchContentType(CompressibleContentTypes, contentType)
+}
+
+// compress returns a reader that streams the compressed content of r.
+// The returned reader must be closed: closing stops the compressing goroutine and waits for it to return.
+func compress(r io.Reader, compression Compression) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+
+	var encoder io.WriteCloser
+	switch compression {
+	case CompressionGzip:
+		encoder = gzip.NewWriter(pw)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(pw)
+		if err != nil {
+			return nil, err
+		}
+		encoder = zw
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := io.Copy(encoder, r)
+		pw.CloseWithError(errors.Join(err, encoder.Close()))
+	}()
+
+	return &compressReader{PipeReader: pr, done: done}, nil
+}
+
+type compressReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close fails the pending writes of the compressing goroutine, and waits for it to return.
+func (t *compressReader) Close() error {
+	err := t.PipeReader.Close()
+	<-t.done
+	return err
+}
+
+type decompressReader struct {
+	io.Reader
+	closers []func() error
+}
+
+func (t *decompressReader) Close() error {
+	var errs []error
+	for _, closer := range t.closers {
+		errs = append(errs, closer())
+	}
+	return errors.Join(errs...)
+}
+
+// decompress wraps the stored content with a decoder for the given encoding.
+// Closing the returned reader closes the stored content as well.
+func decompress(r io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	switch Compression(encoding) {
+	case CompressionGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &decompressReader{Reader: gr, closers: []func() error{gr.Close, r.Close}}, nil
+
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &decompressReader{Reader: zr, closers: []func() error{func() error { zr.Close(); return nil }, r.Close}}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+}
@@ -0,0 +1,105 @@
+package artifacts
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+)
+
+func TestCompression(t *testing.T) {
+	ctx := newTestContext(t)
+	fs := artifactFS.NewLocalFS(t.TempDir())
+
+	text := strings.Repeat("a compressible line of text\n", 100)
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 100)
+
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		content     string
+		compression Compression
+		encoding    string
+		magic       string
+	}{
+		{name: "gzip", path: "gzip.txt", contentType: "text/plain", content: text, compression: CompressionGzip, encoding: "gzip", magic: "\x1f\x8b"},
+		{name: "zstd", path: "zstd.txt", contentType: "text/plain", content: text, compression: CompressionZstd, encoding: "zstd", magic: "\x28\xb5\x2f\xfd"},
+		{name: "incompressible type", path: "image.png", contentType: "image/png", content: png, compression: CompressionGzip, magic: png},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			artifact := &models.Artifact{ConnectionID: uuid.New()}
+			err := SaveArtifact(ctx, fs, artifact, Artifact{
+				Path:          test.path,
+				ContentType:   test.contentType,
+				Content:       streamed(test.content),
+				ContentLength: -1,
+				Compression:   test.compression,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := fs.Read(ctx, test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stored.Close()
+
+			blob, err := io.ReadAll(stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(blob, []byte(test.magic)) {
+				t.Errorf("expected the blob to start with %q, got %q", test.magic, blob[:min(len(blob), 8)])
+			}
+
+			metadata, err := ReadMetadata(ctx, fs, test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if metadata.ContentEncoding != test.encoding {
+				t.Errorf("expected the content encoding %q, got %q", test.encoding, metadata.ContentEncoding)
+			}
+
+			if content := readContent(t, ctx, fs, artifact); content != test.content {
+				t.Errorf("expected the content to round trip, got %d bytes instead of %d", len(content), len(test.content))
+			}
+		})
+	}
+}
+
+func TestCompressClose(t *testing.T) {
+	source := &countingReader{Reader: strings.NewReader(strings.Repeat("a", 10*1024*1024))}
+	compressed, err := compress(source, CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := compressed.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		_ = compressed.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to return once the compressing goroutine stopped")
+	}
+
+	// the goroutine returned, so the source is no longer read
+	if source.read == 10*1024*1024 {
+		t.Error("expected the compression to stop before the whole source was read")
+	}
+}
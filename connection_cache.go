@@ -0,0 +1,337 @@
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+	"golang.org/x/sync/singleflight"
+)
+
+var errCacheClosed = errors.New("filesystem cache is closed")
+
+const (
+	defaultCacheIdleTimeout              = 5 * time.Minute
+	defaultCacheMaxSessionsPerConnection = 4
+)
+
+type FilesystemCacheOptions struct {
+	// IdleTimeout is how long an unused filesystem is kept open. Defaults to 5 minutes.
+	IdleTimeout time.Duration
+
+	// MaxSessionsPerConnection is the number of filesystems opened for a connection.
+	// Once reached, callers share the least used one. Defaults to 4.
+	MaxSessionsPerConnection int
+}
+
+// FilesystemCache keeps the filesystems of connections open between uses, so that SSH and SMB sessions
+// and S3 and GCS clients are not dialed for every artifact.
+//
+// Filesystems are keyed by the connection's ID and a hash of its properties: a connection that was
+// updated gets new filesystems, and those of its previous version are closed once released.
+type FilesystemCache struct {
+	opts FilesystemCacheOptions
+
+	mu       sync.Mutex
+	sessions map[uuid.UUID][]*cachedSession
+	closed   bool
+	stop     chan struct{}
+
+	// opening opens one filesystem at a time per connection version
+	opening singleflight.Group
+}
+
+type cachedSession struct {
+	fs   fs.FilesystemRW
+	hash string
+
+	// refs is the number of callers using the filesystem
+	refs     int
+	lastUsed time.Time
+
+	// stale sessions are closed once their last caller releases them
+	stale bool
+}
+
+func NewFilesystemCache(opts FilesystemCacheOptions) *FilesystemCache {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = defaultCacheIdleTimeout
+	}
+	if opts.MaxSessionsPerConnection <= 0 {
+		opts.MaxSessionsPerConnection = defaultCacheMaxSessionsPerConnection
+	}
+
+	cache := &FilesystemCache{
+		opts:     opts,
+		sessions: map[uuid.UUID][]*cachedSession{},
+		stop:     make(chan struct{}),
+	}
+	go cache.evictIdle()
+	return cache
+}
+
+// Get returns a filesystem for the connection, opening one with GetFSForConnection if needed.
+// Closing the returned filesystem releases it back to the cache.
+//
+// Connections without an ID are not cached: they get a filesystem of their own.
+func (c *FilesystemCache) Get(ctx context.Context, connection models.Connection) (fs.FilesystemRW, error) {
+	if connection.ID == uuid.Nil {
+		return GetFSForConnection(ctx, connection)
+	}
+
+	hash, err := connectionHash(connection)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if session := c.acquire(connection.ID, hash, false); session != nil {
+			return &cachedFS{FilesystemRW: session.fs, cache: c, id: connection.ID, session: session}, nil
+		}
+
+		// callers that need a new filesystem at the same time share the one opened
+		key := connection.ID.String() + "/" + hash
+		if _, err, _ := c.opening.Do(key, func() (any, error) { return nil, c.open(ctx, connection, hash) }); err != nil {
+			return nil, err
+		}
+
+		// the least used filesystem is taken, unless the connection was invalidated in the meantime
+		if session := c.acquire(connection.ID, hash, true); session != nil {
+			return &cachedFS{FilesystemRW: session.fs, cache: c, id: connection.ID, session: session}, nil
+		}
+	}
+}
+
+// open adds a filesystem for the connection, unless it already has as many as allowed.
+func (c *FilesystemCache) open(ctx context.Context, connection models.Connection, hash string) error {
+	c.mu.Lock()
+	closed, open := c.closed, c.current(connection.ID, hash)
+	c.mu.Unlock()
+	if closed {
+		return errCacheClosed
+	}
+	if open >= c.opts.MaxSessionsPerConnection {
+		return nil
+	}
+
+	filesystem, err := GetFSForConnection(ctx, connection)
+	if err != nil {
+		return err
+	}
+	if filesystem == nil {
+		return fmt.Errorf("connection type %q does not support artifacts", connection.Type)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		_ = filesystem.Close()
+		return errCacheClosed
+	}
+	c.sessions[connection.ID] = append(c.sessions[connection.ID], &cachedSession{fs: filesystem, hash: hash, lastUsed: time.Now()})
+	return nil
+}
+
+// current returns the number of filesystems of the connection's version. c.mu must be held.
+func (c *FilesystemCache) current(id uuid.UUID, hash string) int {
+	var count int
+	for _, session := range c.sessions[id] {
+		if session.hash == hash && !session.stale {
+			count++
+		}
+	}
+	return count
+}
+
+// GetByID returns a filesystem for the connection with the given ID, as stored in the database.
+// Filesystems of a previous version of the connection are invalidated.
+func (c *FilesystemCache) GetByID(ctx context.Context, id uuid.UUID) (fs.FilesystemRW, error) {
+	var connection models.Connection
+	if err := ctx.DB().Where("id = ? AND deleted_at IS NULL", id).First(&connection).Error; err != nil {
+		return nil, fmt.Errorf("error getting connection(%s): %w", id, err)
+	}
+
+	return c.Get(ctx, connection)
+}
+
+// acquire returns the session to use for a connection, or nil if a new one should be opened.
+// Sessions of other versions of the connection are marked stale.
+func (c *FilesystemCache) acquire(id uuid.UUID, hash string, force bool) *cachedSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var kept, current []*cachedSession
+	for _, session := range c.sessions[id] {
+		if session.hash != hash {
+			session.stale = true
+		}
+
+		if session.stale && session.refs == 0 {
+			_ = session.fs.Close()
+			continue
+		}
+
+		kept = append(kept, session)
+		if !session.stale {
+			current = append(current, session)
+		}
+	}
+	c.sessions[id] = kept
+
+	var leastUsed *cachedSession
+	for _, session := range current {
+		if leastUsed == nil || session.refs < leastUsed.refs {
+			leastUsed = session
+		}
+	}
+
+	if leastUsed == nil || (!force && leastUsed.refs > 0 && len(current) < c.opts.MaxSessionsPerConnection) {
+		return nil
+	}
+
+	leastUsed.refs++
+	return leastUsed
+}
+
+func (c *FilesystemCache) release(id uuid.UUID, session *cachedSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	session.refs--
+	session.lastUsed = time.Now()
+	if session.refs > 0 || !session.stale {
+		return
+	}
+
+	_ = session.fs.Close()
+	c.remove(id, session)
+}
+
+func (c *FilesystemCache) remove(id uuid.UUID, session *cachedSession) {
+	sessions := c.sessions[id]
+	for i, s := range sessions {
+		if s == session {
+			c.sessions[id] = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+
+	if len(c.sessions[id]) == 0 {
+		delete(c.sessions, id)
+	}
+}
+
+// Invalidate closes the filesystems of a connection, e.g. after it was updated or deleted.
+// Filesystems still in use are closed once released.
+func (c *FilesystemCache) Invalidate(id uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, session := range c.sessions[id] {
+		session.stale = true
+		if session.refs == 0 {
+			_ = session.fs.Close()
+			c.remove(id, session)
+		}
+	}
+}
+
+func (c *FilesystemCache) evictIdle() {
+	ticker := time.NewTicker(c.opts.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		for id, sessions := range c.sessions {
+			for _, session := range sessions {
+				if session.refs == 0 && time.Since(session.lastUsed) > c.opts.IdleTimeout {
+					_ = session.fs.Close()
+					c.remove(id, session)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Close closes every filesystem of the cache. Filesystems still in use are closed once released.
+func (c *FilesystemCache) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	ids := make([]uuid.UUID, 0, len(c.sessions))
+	for id := range c.sessions {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+
+	close(c.stop)
+	for _, id := range ids {
+		c.Invalidate(id)
+	}
+	return nil
+}
+
+// cachedFS is a filesystem handed out by the cache. Closing it releases it back to the cache.
+type cachedFS struct {
+	fs.FilesystemRW
+	cache   *FilesystemCache
+	id      uuid.UUID
+	session *cachedSession
+	once    sync.Once
+}
+
+func (t *cachedFS) Close() error {
+	t.once.Do(func() { t.cache.release(t.id, t.session) })
+	return nil
+}
+
+// The session health and truncated listings of the cached filesystem are forwarded. Its listing limit
+// and encryption are not: the filesystem is shared, so they would apply to every user of the session.
+
+func (t *cachedFS) Health() fs.SessionHealth {
+	if reporter, ok := t.FilesystemRW.(fs.HealthReporter); ok {
+		return reporter.Health()
+	}
+	return fs.SessionHealth{}
+}
+
+func (t *cachedFS) ReadDirTruncated(name string) ([]fs.FileInfo, bool, error) {
+	if lister, ok := t.FilesystemRW.(fs.TruncatingLister); ok {
+		return lister.ReadDirTruncated(name)
+	}
+
+	files, err := t.FilesystemRW.ReadDir(name)
+	return files, false, err
+}
+
+// connectionHash identifies the version of a connection by everything a filesystem is built from.
+func connectionHash(connection models.Connection) (string, error) {
+	content, err := json.Marshal([]any{
+		connection.Type, connection.URL, connection.Username, connection.Password, connection.Certificate,
+		connection.InsecureTLS, connection.Properties, connection.UpdatedAt,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,149 @@
+package artifacts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/flanksource/duty/types"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestFilesystemCache(t *testing.T) {
+	ctx := context.New()
+	cache := NewFilesystemCache(FilesystemCacheOptions{MaxSessionsPerConnection: 2})
+	defer cache.Close()
+
+	connection := models.Connection{
+		ID:         uuid.New(),
+		Type:       models.ConnectionTypeFolder,
+		Properties: types.JSONStringMap{"path": t.TempDir()},
+	}
+
+	var handles []*cachedFS
+	for range 3 {
+		filesystem, err := cache.Get(ctx, connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, filesystem.(*cachedFS))
+	}
+
+	if handles[0].session == handles[1].session {
+		t.Error("expected a second session while the first is in use")
+	}
+	if handles[2].session != handles[0].session && handles[2].session != handles[1].session {
+		t.Error("expected sessions to be shared once the limit is reached")
+	}
+
+	for _, handle := range handles {
+		_ = handle.Close()
+	}
+
+	connection.UpdatedAt = time.Now()
+	updated, err := cache.Get(ctx, connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer updated.Close()
+
+	if updated.(*cachedFS).session == handles[0].session || updated.(*cachedFS).session == handles[1].session {
+		t.Error("expected a new session for the updated connection")
+	}
+	if sessions := len(cache.sessions[connection.ID]); sessions != 1 {
+		t.Errorf("expected the sessions of the previous version to be closed, got %d sessions", sessions)
+	}
+}
+
+func TestFilesystemCacheConcurrentGet(t *testing.T) {
+	ctx := context.New()
+	cache := NewFilesystemCache(FilesystemCacheOptions{MaxSessionsPerConnection: 2})
+	defer cache.Close()
+
+	connection := models.Connection{
+		ID:         uuid.New(),
+		Type:       models.ConnectionTypeFolder,
+		Properties: types.JSONStringMap{"path": t.TempDir()},
+	}
+
+	var group errgroup.Group
+	for range 16 {
+		group.Go(func() error {
+			_, err := cache.Get(ctx, connection)
+			return err
+		})
+	}
+	if err := group.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sessions := len(cache.sessions[connection.ID]); sessions != 2 {
+		t.Errorf("expected the connection to have 2 sessions, got %d", sessions)
+	}
+}
+
+func TestFilesystemCacheWithoutID(t *testing.T) {
+	ctx := context.New()
+	cache := NewFilesystemCache(FilesystemCacheOptions{})
+	defer cache.Close()
+
+	for range 2 {
+		filesystem, err := cache.Get(ctx, models.Connection{Type: models.ConnectionTypeFolder, Properties: types.JSONStringMap{"path": t.TempDir()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := filesystem.(*cachedFS); ok {
+			t.Error("expected a connection without an ID not to be cached")
+		}
+		_ = filesystem.Close()
+	}
+
+	if len(cache.sessions) != 0 {
+		t.Errorf("expected no cached sessions, got %d", len(cache.sessions))
+	}
+}
+
+func TestFilesystemCacheUnsupportedType(t *testing.T) {
+	ctx := context.New()
+	cache := NewFilesystemCache(FilesystemCacheOptions{})
+	defer cache.Close()
+
+	connection := models.Connection{ID: uuid.New(), Type: models.ConnectionTypeHTTP}
+	for range 2 {
+		if filesystem, err := cache.Get(ctx, connection); err == nil {
+			t.Fatalf("expected an unsupported connection type to fail, got %v", filesystem)
+		}
+	}
+
+	if len(cache.sessions[connection.ID]) != 0 {
+		t.Errorf("expected nothing to be cached, got %d sessions", len(cache.sessions[connection.ID]))
+	}
+}
+
+func TestCachedFSOptionalInterfaces(t *testing.T) {
+	ctx := context.New()
+	cache := NewFilesystemCache(FilesystemCacheOptions{})
+	defer cache.Close()
+
+	filesystem, err := cache.Get(ctx, models.Connection{ID: uuid.New(), Type: models.ConnectionTypeFolder, Properties: types.JSONStringMap{"path": t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+
+	if _, ok := filesystem.(fs.TruncatingLister); !ok {
+		t.Error("expected truncated listings to be forwarded")
+	}
+	if _, ok := filesystem.(fs.HealthReporter); !ok {
+		t.Error("expected the session health to be forwarded")
+	}
+	if _, ok := filesystem.(fs.ListItemLimiter); ok {
+		t.Error("expected the listing limit of the shared filesystem not to be settable")
+	}
+	if _, ok := filesystem.(fs.ServerSideEncrypter); ok {
+		t.Error("expected the encryption of the shared filesystem not to be settable")
+	}
+}
@@ -0,0 +1,226 @@
+package artifacts
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+)
+
+// ConnectionCheckStep is a step of TestConnection, in the order they are run.
+type ConnectionCheckStep string
+
+const (
+	CheckReachability   ConnectionCheckStep = "reachability"
+	CheckAuthentication ConnectionCheckStep = "authentication"
+	CheckList           ConnectionCheckStep = "list"
+	CheckWrite          ConnectionCheckStep = "write"
+	CheckRead           ConnectionCheckStep = "read"
+	CheckDelete         ConnectionCheckStep = "delete"
+)
+
+type ConnectionCheckStatus string
+
+const (
+	CheckPassed  ConnectionCheckStatus = "passed"
+	CheckFailed  ConnectionCheckStatus = "failed"
+	CheckSkipped ConnectionCheckStatus = "skipped"
+
+	// CheckUnknown is the status of a step that was neither shown to pass nor to fail.
+	CheckUnknown ConnectionCheckStatus = "unknown"
+)
+
+type ConnectionCheckResult struct {
+	Step   ConnectionCheckStep   `json:"step"`
+	Status ConnectionCheckStatus `json:"status"`
+	Error  string                `json:"error,omitempty"`
+}
+
+// ConnectionReport is the outcome of TestConnection.
+type ConnectionReport struct {
+	Steps    []ConnectionCheckResult `json:"steps"`
+	Duration time.Duration           `json:"duration"`
+}
+
+// OK reports whether every step that was run passed.
+func (t ConnectionReport) OK() bool {
+	return t.Failed() == nil
+}
+
+// Failed returns the step that failed, if any.
+func (t ConnectionReport) Failed() *ConnectionCheckResult {
+	for i, step := range t.Steps {
+		if step.Status == CheckFailed {
+			return &t.Steps[i]
+		}
+	}
+	return nil
+}
+
+type ConnectionTestOptions struct {
+	// Probe writes a small object, reads it back and deletes it again.
+	Probe bool
+
+	// ProbePath is where the probe object is written. Defaults to a unique name at the root of the connection.
+	ProbePath string
+}
+
+// TestConnection checks that artifacts can be stored on a connection: that its server is reachable,
+// accepts the credentials and allows listing, and optionally that an object can be written, read and deleted.
+//
+// Reachability and authentication are checked when the filesystem is opened for SFTP and SMB,
+// and by the list step for S3 and GCS, whose clients only connect on their first request.
+// The list step lists a single object. Steps after the failed one are skipped.
+func TestConnection(ctx context.Context, connection models.Connection, opts ConnectionTestOptions) *ConnectionReport {
+	start := time.Now()
+	check := &connectionCheck{}
+	defer func() { check.report.Duration = time.Since(start) }()
+
+	filesystem, err := GetFSForConnection(ctx, connection)
+	if err == nil && filesystem == nil {
+		err = fmt.Errorf("connection type %q does not support artifacts", connection.Type)
+	}
+	if err != nil {
+		// an error other than an unreachable server means the credentials could not be resolved or used,
+		// before or without the server being reached
+		check.failOpen(err)
+		return check.finish(opts)
+	}
+	defer func() { _ = filesystem.Close() }()
+
+	if limiter, ok := filesystem.(fs.ListItemLimiter); ok {
+		limiter.SetMaxListItems(1)
+	}
+
+	if _, err := filesystem.ReadDir("."); err != nil {
+		check.fail(CheckList, err)
+		return check.finish(opts)
+	}
+	check.pass(CheckReachability, CheckAuthentication, CheckList)
+
+	if !opts.Probe {
+		return check.finish(opts)
+	}
+
+	probePath := opts.ProbePath
+	if probePath == "" {
+		probePath = fmt.Sprintf(".artifacts-connection-test-%s", uuid.NewString())
+	}
+	content := []byte("artifacts connection test")
+
+	if _, err := filesystem.Write(ctx, probePath, bytes.NewReader(content)); err != nil {
+		check.fail(CheckWrite, err)
+		return check.finish(opts)
+	}
+	check.pass(CheckWrite)
+
+	if err := readProbe(ctx, filesystem, probePath, content); err != nil {
+		check.fail(CheckRead, err)
+	} else {
+		check.pass(CheckRead)
+	}
+
+	// the probe is deleted even if it could not be read back
+	if err := filesystem.Delete(ctx, probePath); err != nil {
+		check.fail(CheckDelete, err)
+	} else {
+		check.pass(CheckDelete)
+	}
+
+	return check.finish(opts)
+}
+
+func readProbe(ctx context.Context, filesystem fs.FilesystemRW, path string, expected []byte) error {
+	reader, err := filesystem.Read(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = reader.Close() }()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(content, expected) {
+		return fmt.Errorf("read %d bytes that differ from the %d bytes written", len(content), len(expected))
+	}
+	return nil
+}
+
+type connectionCheck struct {
+	report ConnectionReport
+}
+
+func (t *connectionCheck) pass(steps ...ConnectionCheckStep) {
+	for _, step := range steps {
+		t.report.Steps = append(t.report.Steps, ConnectionCheckResult{Step: step, Status: CheckPassed})
+	}
+}
+
+// fail records the failure of step. Until the list step has passed, a failure is attributed to an earlier step
+// when the error shows that the server could not be reached or rejected the credentials.
+func (t *connectionCheck) fail(step ConnectionCheckStep, err error) {
+	failed := step
+	if !t.has(CheckList) {
+		switch {
+		case fs.IsUnreachable(err):
+			failed = CheckReachability
+		case fs.IsAuthenticationError(err):
+			failed = CheckAuthentication
+		}
+	}
+
+	for _, earlier := range []ConnectionCheckStep{CheckReachability, CheckAuthentication, CheckList} {
+		if earlier == failed || t.has(earlier) {
+			break
+		}
+		t.pass(earlier)
+	}
+
+	t.report.Steps = append(t.report.Steps, ConnectionCheckResult{Step: failed, Status: CheckFailed, Error: err.Error()})
+}
+
+// failOpen records the failure to open the filesystem. Unless the error shows otherwise,
+// whether the server could be reached is unknown.
+func (t *connectionCheck) failOpen(err error) {
+	if fs.IsUnreachable(err) || fs.IsAuthenticationError(err) {
+		t.fail(CheckAuthentication, err)
+		return
+	}
+
+	t.report.Steps = append(t.report.Steps,
+		ConnectionCheckResult{Step: CheckReachability, Status: CheckUnknown},
+		ConnectionCheckResult{Step: CheckAuthentication, Status: CheckFailed, Error: err.Error()},
+	)
+}
+
+func (t *connectionCheck) has(step ConnectionCheckStep) bool {
+	for _, result := range t.report.Steps {
+		if result.Step == step {
+			return true
+		}
+	}
+	return false
+}
+
+// finish marks the steps that were not run as skipped.
+func (t *connectionCheck) finish(opts ConnectionTestOptions) *ConnectionReport {
+	steps := []ConnectionCheckStep{CheckReachability, CheckAuthentication, CheckList}
+	if opts.Probe {
+		steps = append(steps, CheckWrite, CheckRead, CheckDelete)
+	}
+
+	for _, step := range steps {
+		if !t.has(step) {
+			t.report.Steps = append(t.report.Steps, ConnectionCheckResult{Step: step, Status: CheckSkipped})
+		}
+	}
+
+	return &t.report
+}
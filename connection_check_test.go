@@ -0,0 +1,45 @@
+package artifacts
+
+import (
+	"testing"
+
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/flanksource/duty/types"
+)
+
+func TestTestConnection(t *testing.T) {
+	connection := models.Connection{
+		Type:       models.ConnectionTypeFolder,
+		Properties: types.JSONStringMap{"path": t.TempDir()},
+	}
+
+	report := TestConnection(context.New(), connection, ConnectionTestOptions{Probe: true})
+	if !report.OK() {
+		t.Fatalf("expected the connection to pass, got %+v", report.Steps)
+	}
+	if len(report.Steps) != 6 {
+		t.Errorf("expected 6 steps, got %+v", report.Steps)
+	}
+
+	connection.Properties["path"] = "/nonexistent/artifacts"
+	report = TestConnection(context.New(), connection, ConnectionTestOptions{Probe: true})
+	if failed := report.Failed(); failed == nil || failed.Step != CheckList {
+		t.Errorf("expected the list step to fail, got %+v", report.Steps)
+	}
+}
+
+func TestTestConnectionOpenFailure(t *testing.T) {
+	connection := models.Connection{
+		Type:       models.ConnectionTypeFolder,
+		Properties: types.JSONStringMap{"path": t.TempDir(), "bandwidthLimit": "invalid"},
+	}
+
+	report := TestConnection(context.New(), connection, ConnectionTestOptions{})
+	if report.Steps[0].Step != CheckReachability || report.Steps[0].Status != CheckUnknown {
+		t.Errorf("expected reachability to be unknown, got %+v", report.Steps)
+	}
+	if failed := report.Failed(); failed == nil || failed.Step != CheckAuthentication {
+		t.Errorf("expected the authentication step to fail, got %+v", report.Steps)
+	}
+}
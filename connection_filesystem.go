@@ -1,6 +1,7 @@
 package artifacts
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/url"
 	"strconv"
@@ -14,7 +15,47 @@ import (
 	"github.com/flanksource/duty/types"
 )
 
+// GetFSForConnection returns the filesystem of a connection, traced and measured under its type, see fs.NewInstrumentedFS.
+// Connections with a bandwidthLimit property (in bytes per second) share that bandwidth across their open filesystems.
 func GetFSForConnection(ctx context.Context, c models.Connection) (fs.FilesystemRW, error) {
+	filesystem, err := newFSForConnection(ctx, c)
+	if err != nil || filesystem == nil {
+		return filesystem, err
+	}
+	filesystem = fs.NewInstrumentedFS(ctx, filesystem, c.Type)
+
+	bytesPerSecond, err := bandwidthLimit(c)
+	if err != nil {
+		_ = filesystem.Close()
+		return nil, err
+	}
+
+	switch {
+	case bytesPerSecond == 0:
+		return filesystem, nil
+	case c.ID == uuid.Nil:
+		return fs.NewThrottledFS(filesystem, fs.NewBandwidthLimiter(bytesPerSecond)), nil
+	default:
+		return fs.NewSharedThrottledFS(filesystem, fmt.Sprintf("%s/%d", c.ID, bytesPerSecond), bytesPerSecond), nil
+	}
+}
+
+// bandwidthLimit returns the bandwidthLimit property of a connection, or 0 if it has none.
+func bandwidthLimit(c models.Connection) (int, error) {
+	value := c.Properties["bandwidthLimit"]
+	if value == "" {
+		return 0, nil
+	}
+
+	bytesPerSecond, err := strconv.Atoi(value)
+	if err != nil || bytesPerSecond <= 0 {
+		return 0, fmt.Errorf("invalid bandwidthLimit %q: must be a positive number of bytes per second", value)
+	}
+
+	return bytesPerSecond, nil
+}
+
+func newFSForConnection(ctx context.Context, c models.Connection) (fs.FilesystemRW, error) {
 	switch c.Type {
 	case models.ConnectionTypeFolder:
 		path := c.Properties["path"]
@@ -45,7 +86,17 @@ func GetFSForConnection(ctx context.Context, c models.Connection) (fs.Filesystem
 			return nil, err
 		}
 
-		return fs.NewS3FS(ctx, conn.Bucket, conn)
+		sse, err := serverSideEncryption(c.Properties)
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := fs.NewS3FS(ctx, conn.Bucket, conn)
+		if err != nil {
+			return nil, err
+		}
+		client.SetServerSideEncryption(sse)
+		return client, nil
 
 	case models.ConnectionTypeGCS:
 		var conn connection.GCSConnection
@@ -61,10 +112,16 @@ func GetFSForConnection(ctx context.Context, c models.Connection) (fs.Filesystem
 			return nil, err
 		}
 
+		sse, err := serverSideEncryption(c.Properties)
+		if err != nil {
+			return nil, err
+		}
+
 		client, err := fs.NewGCSFS(ctx, conn.Bucket, conn)
 		if err != nil {
 			return nil, err
 		}
+		client.SetServerSideEncryption(sse)
 		return client, nil
 
 	case models.ConnectionTypeSFTP:
@@ -90,3 +147,28 @@ func GetFSForConnection(ctx context.Context, c models.Connection) (fs.Filesystem
 
 	return nil, nil
 }
+
+// serverSideEncryption reads the server-side encryption of S3 and GCS connections from their properties:
+//   - sse: the S3 encryption algorithm (AES256, aws:kms, aws:kms:dsse)
+//   - kmsKeyID: the S3 KMS key ID or the GCS Cloud KMS key name
+//   - customerKey: a base64 encoded customer-provided key (SSE-C / CSEK)
+func serverSideEncryption(properties map[string]string) (*fs.ServerSideEncryption, error) {
+	sse := fs.ServerSideEncryption{
+		Algorithm: properties["sse"],
+		KMSKeyID:  properties["kmsKeyID"],
+	}
+
+	if customerKey := properties["customerKey"]; customerKey != "" {
+		key, err := base64.StdEncoding.DecodeString(customerKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid customerKey: %w", err)
+		}
+		sse.CustomerKey = key
+	}
+
+	if sse.Algorithm == "" && sse.KMSKeyID == "" && len(sse.CustomerKey) == 0 {
+		return nil, nil
+	}
+
+	return &sse, nil
+}
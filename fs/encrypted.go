@@ -0,0 +1,398 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	gocontext "context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// encryptionMagic starts every blob written by the encrypted filesystem.
+var encryptionMagic = []byte("FLKE")
+
+const (
+	encryptionVersion   = 1
+	encryptionChunkSize = 64 * 1024
+	noncePrefixSize     = 8
+	dataKeySize         = 32
+)
+
+// KeyProvider generates the per-object data keys used by the encrypted filesystem
+// and unwraps them again on read, similar to the GenerateDataKey/Decrypt calls of a KMS.
+type KeyProvider interface {
+	// GenerateDataKey returns a new 256-bit data key in plaintext and in wrapped form.
+	// Only the wrapped form is stored.
+	GenerateDataKey(ctx gocontext.Context) (plaintext, wrapped []byte, err error)
+
+	// DecryptDataKey returns the plaintext of a data key wrapped by GenerateDataKey.
+	DecryptDataKey(ctx gocontext.Context, wrapped []byte) ([]byte, error)
+}
+
+// encryptedFS implements FilesystemRW with client-side envelope encryption.
+//
+// Every object is encrypted with its own data key using AES-256-GCM in 64KiB chunks,
+// so content is streamed rather than buffered. The data key, wrapped by the KeyProvider,
+// is stored in a header at the start of the object.
+//
+// Stat and ReadDir report the size of the encrypted object.
+type encryptedFS struct {
+	FilesystemRW
+	keys KeyProvider
+}
+
+func NewEncryptedFS(fs FilesystemRW, keys KeyProvider) *encryptedFS {
+	return &encryptedFS{FilesystemRW: fs, keys: keys}
+}
+
+// IsEncrypted reports whether the content starting with header was written by the encrypted filesystem.
+func IsEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, encryptionMagic)
+}
+
+func (t *encryptedFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
+	plaintext, wrapped, err := t.keys.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error generating data key: %w", err)
+	}
+
+	if len(wrapped) > math.MaxUint16 {
+		return nil, fmt.Errorf("wrapped data key is too large (%d bytes)", len(wrapped))
+	}
+
+	aead, err := newAEAD(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+
+	header := bytes.NewBuffer(nil)
+	header.Write(encryptionMagic)
+	header.WriteByte(encryptionVersion)
+	_ = binary.Write(header, binary.BigEndian, uint16(len(wrapped)))
+	header.Write(wrapped)
+	header.Write(noncePrefix)
+
+	reader := &encryptReader{
+		chunkCipher: chunkCipher{aead: aead, noncePrefix: noncePrefix},
+		src:         bufio.NewReader(data),
+		buf:         header.Bytes(),
+		plain:       make([]byte, encryptionChunkSize),
+		length:      -1,
+	}
+
+	if length := getContentLength(data); length >= 0 {
+		chunks := max((length+encryptionChunkSize-1)/encryptionChunkSize, 1)
+		reader.length = int64(header.Len()) + length + chunks*int64(aead.Overhead())
+	}
+
+	return t.FilesystemRW.Write(ctx, path, reader)
+}
+
+func (t *encryptedFS) Read(ctx gocontext.Context, path string) (io.ReadCloser, error) {
+	file, err := t.FilesystemRW.Read(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := t.decryptReader(ctx, file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("error decrypting %s: %w", path, err)
+	}
+
+	return reader, nil
+}
+
+func (t *encryptedFS) ReadDirTruncated(name string) ([]FileInfo, bool, error) {
+	return readDir(t.FilesystemRW, name)
+}
+
+func (t *encryptedFS) SetMaxListItems(max int) {
+	setMaxListItems(t.FilesystemRW, max)
+}
+
+// SetServerSideEncryption sets the encryption the backend applies on top of the client-side encryption.
+func (t *encryptedFS) SetServerSideEncryption(sse *ServerSideEncryption) {
+	setServerSideEncryption(t.FilesystemRW, sse)
+}
+
+func (t *encryptedFS) Health() SessionHealth {
+	return health(t.FilesystemRW)
+}
+
+func (t *encryptedFS) decryptReader(ctx gocontext.Context, file io.ReadCloser) (*decryptReader, error) {
+	src := bufio.NewReader(file)
+
+	prefix := make([]byte, len(encryptionMagic)+1+2)
+	if _, err := io.ReadFull(src, prefix); err != nil {
+		return nil, fmt.Errorf("error reading encryption header: %w", err)
+	}
+
+	if !IsEncrypted(prefix) {
+		return nil, errors.New("content is not encrypted")
+	}
+
+	if version := prefix[len(encryptionMagic)]; version != encryptionVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", version)
+	}
+
+	wrapped := make([]byte, binary.BigEndian.Uint16(prefix[len(encryptionMagic)+1:]))
+	if _, err := io.ReadFull(src, wrapped); err != nil {
+		return nil, fmt.Errorf("error reading data key: %w", err)
+	}
+
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(src, noncePrefix); err != nil {
+		return nil, fmt.Errorf("error reading nonce: %w", err)
+	}
+
+	plaintext, err := t.keys.DecryptDataKey(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data key: %w", err)
+	}
+
+	aead, err := newAEAD(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		chunkCipher: chunkCipher{aead: aead, noncePrefix: noncePrefix},
+		src:         src,
+		closer:      file,
+		sealed:      make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkCipher derives a unique nonce for every chunk from a random prefix and the chunk index.
+// The last chunk is sealed with different additional data, so truncation is detected.
+type chunkCipher struct {
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+}
+
+func (t *chunkCipher) nextNonce() ([]byte, error) {
+	if t.counter == math.MaxUint32 {
+		return nil, errors.New("content is too large to encrypt")
+	}
+
+	nonce := make([]byte, t.aead.NonceSize())
+	copy(nonce, t.noncePrefix)
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], t.counter)
+	t.counter++
+	return nonce, nil
+}
+
+func chunkAdditionalData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// isFinalChunk reports whether a chunk of n bytes out of a buffer of size bytes is the last one.
+func isFinalChunk(src *bufio.Reader, n, size int) (bool, error) {
+	if n < size {
+		return true, nil
+	}
+
+	if _, err := src.Peek(1); err != nil {
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return false, nil
+}
+
+type encryptReader struct {
+	chunkCipher
+	src    *bufio.Reader
+	buf    []byte // sealed output not yet returned
+	plain  []byte
+	done   bool
+	length int64
+}
+
+// ContentLength returns the size of the encrypted content if the plaintext size is known, -1 otherwise
+func (t *encryptReader) ContentLength() int64 {
+	return t.length
+}
+
+func (t *encryptReader) Read(p []byte) (int, error) {
+	for len(t.buf) == 0 {
+		if t.done {
+			return 0, io.EOF
+		}
+
+		if err := t.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+func (t *encryptReader) sealNext() error {
+	n, err := io.ReadFull(t.src, t.plain)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	final, err := isFinalChunk(t.src, n, len(t.plain))
+	if err != nil {
+		return err
+	}
+
+	nonce, err := t.nextNonce()
+	if err != nil {
+		return err
+	}
+
+	t.buf = t.aead.Seal(nil, nonce, t.plain[:n], chunkAdditionalData(final))
+	t.done = final
+	return nil
+}
+
+type decryptReader struct {
+	chunkCipher
+	src    *bufio.Reader
+	closer io.Closer
+	buf    []byte // decrypted output not yet returned
+	sealed []byte
+	done   bool
+}
+
+func (t *decryptReader) Read(p []byte) (int, error) {
+	for len(t.buf) == 0 {
+		if t.done {
+			return 0, io.EOF
+		}
+
+		if err := t.openNext(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+func (t *decryptReader) openNext() error {
+	n, err := io.ReadFull(t.src, t.sealed)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	final, err := isFinalChunk(t.src, n, len(t.sealed))
+	if err != nil {
+		return err
+	}
+
+	nonce, err := t.nextNonce()
+	if err != nil {
+		return err
+	}
+
+	t.buf, err = t.aead.Open(nil, nonce, t.sealed[:n], chunkAdditionalData(final))
+	if err != nil {
+		return fmt.Errorf("error decrypting content: %w", err)
+	}
+
+	t.done = final
+	return nil
+}
+
+func (t *decryptReader) Close() error {
+	return t.closer.Close()
+}
+
+// LocalKeyProvider wraps data keys with a master key held in memory.
+// It is intended for tests and single-node setups; production deployments should use a KMS backed KeyProvider.
+type LocalKeyProvider struct {
+	aead cipher.AEAD
+}
+
+// NewLocalKeyProvider creates a key provider from a 256-bit master key.
+func NewLocalKeyProvider(masterKey []byte) (*LocalKeyProvider, error) {
+	if len(masterKey) != dataKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", dataKeySize, len(masterKey))
+	}
+
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalKeyProvider{aead: aead}, nil
+}
+
+// NewLocalKeyProviderFromFile reads the master key from a keyfile
+// containing either the raw 32 bytes or their base64 encoding.
+func NewLocalKeyProviderFromFile(path string) (*LocalKeyProvider, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyfile: %w", err)
+	}
+
+	if len(content) == dataKeySize {
+		return NewLocalKeyProvider(content)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(content)))
+	if err != nil {
+		return nil, fmt.Errorf("keyfile must contain %d raw or base64 encoded bytes: %w", dataKeySize, err)
+	}
+
+	return NewLocalKeyProvider(key)
+}
+
+func (t *LocalKeyProvider) GenerateDataKey(ctx gocontext.Context) ([]byte, []byte, error) {
+	plaintext := make([]byte, dataKeySize)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return plaintext, t.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (t *LocalKeyProvider) DecryptDataKey(ctx gocontext.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < t.aead.NonceSize() {
+		return nil, errors.New("wrapped data key is too short")
+	}
+
+	nonce, sealed := wrapped[:t.aead.NonceSize()], wrapped[t.aead.NonceSize():]
+	return t.aead.Open(nil, nonce, sealed, nil)
+}
@@ -0,0 +1,144 @@
+package fs
+
+import (
+	"bytes"
+	gocontext "context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedFS(t *testing.T) {
+	ctx := gocontext.TODO()
+
+	keys, err := NewLocalKeyProvider(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := t.TempDir()
+	encrypted := NewEncryptedFS(NewLocalFS(base), keys)
+
+	for _, size := range []int{0, 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize - 7} {
+		content := make([]byte, size)
+		if _, err := rand.Read(content); err != nil {
+			t.Fatal(err)
+		}
+
+		name := filepath.Join("sizes", string(rune('a'+size%26)))
+		info, err := encrypted.Write(ctx, name, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+
+		raw, err := os.ReadFile(filepath.Join(base, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !IsEncrypted(raw) || int64(len(raw)) != info.Size() {
+			t.Fatalf("size %d: expected encrypted content of %d bytes, got %d", size, info.Size(), len(raw))
+		}
+
+		if size > 16 && bytes.Contains(raw, content) {
+			t.Fatalf("size %d: plaintext found in stored content", size)
+		}
+
+		reader, err := encrypted.Read(ctx, name)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+
+		decrypted, err := io.ReadAll(reader)
+		_ = reader.Close()
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+
+		if !bytes.Equal(decrypted, content) {
+			t.Errorf("size %d: decrypted content does not match", size)
+		}
+	}
+}
+
+func TestEncryptedFSDetectsTampering(t *testing.T) {
+	ctx := gocontext.TODO()
+
+	keys, err := NewLocalKeyProvider(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := t.TempDir()
+	encrypted := NewEncryptedFS(NewLocalFS(base), keys)
+
+	content := bytes.Repeat([]byte("secret"), encryptionChunkSize)
+	if _, err := encrypted.Write(ctx, "secret.txt", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(base, "secret.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]byte{
+		"flipped":   append(append([]byte{}, raw[:len(raw)-1]...), raw[len(raw)-1]^1),
+		"truncated": raw[:len(raw)-encryptionChunkSize],
+	}
+
+	for name, tampered := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(base, name), tampered, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			reader, err := encrypted.Read(ctx, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = reader.Close() }()
+
+			if _, err := io.ReadAll(reader); err == nil {
+				t.Error("expected tampered content to fail decryption")
+			}
+		})
+	}
+}
+
+func TestEncryptedFSForwardsOptionalInterfaces(t *testing.T) {
+	keys, err := NewLocalKeyProvider(bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3, requests := newFakeS3(t)
+	var wrapped FilesystemRW = NewEncryptedFS(s3, keys)
+
+	limiter, ok := wrapped.(ListItemLimiter)
+	if !ok {
+		t.Fatal("expected the wrapper to forward SetMaxListItems")
+	}
+	limiter.SetMaxListItems(1)
+
+	if _, ok := wrapped.(ServerSideEncrypter); !ok {
+		t.Error("expected the wrapper to forward SetServerSideEncryption")
+	}
+	if _, ok := wrapped.(HealthReporter); !ok {
+		t.Error("expected the wrapper to forward Health")
+	}
+
+	_, truncated, err := wrapped.(TruncatingLister).ReadDirTruncated(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("expected the truncation of the listing to be forwarded")
+	}
+	if query := requests()[0].Query; !strings.Contains(query, "max-keys=1") {
+		t.Errorf("expected the listing limit to reach the filesystem, got %s", query)
+	}
+}
@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+var (
+	// ErrAlreadyExists is returned by writes with WriteFailIfExists when something is stored at the path.
+	// It is os.ErrExist, so either can be checked with errors.Is.
+	ErrAlreadyExists = os.ErrExist
+
+	// ErrPreconditionFailed is returned by writes with WriteIfMatch when the content has changed.
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// notExistError wraps a backend specific "not found" error
+// so that it satisfies errors.Is(err, os.ErrNotExist).
+type notExistError struct {
+	err error
+}
+
+func (e notExistError) Error() string {
+	return e.err.Error()
+}
+
+func (e notExistError) Unwrap() []error {
+	return []error{e.err, os.ErrNotExist}
+}
+
+// conditionError wraps a backend specific error of a conditional write
+// so that it satisfies errors.Is(err, ErrAlreadyExists) or errors.Is(err, ErrPreconditionFailed).
+type conditionError struct {
+	err      error
+	sentinel error
+}
+
+func (e conditionError) Error() string {
+	return e.err.Error()
+}
+
+func (e conditionError) Unwrap() []error {
+	return []error{e.err, e.sentinel}
+}
+
+// conditionFailed wraps the error of a write whose condition did not hold.
+func conditionFailed(mode WriteMode, err error) error {
+	if mode == WriteIfMatch {
+		return conditionError{err: err, sentinel: ErrPreconditionFailed}
+	}
+	return conditionError{err: err, sentinel: ErrAlreadyExists}
+}
+
+// IsUnreachable reports whether err means the server could not be reached:
+// its name did not resolve, or the connection was refused or timed out.
+func IsUnreachable(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsAuthenticationError reports whether err means the server rejected the credentials.
+func IsAuthenticationError(err error) bool {
+	return isAuthErrorSFTP(err) || isAuthErrorSMB(err) || isAuthErrorS3(err) || isAuthErrorGCS(err)
+}
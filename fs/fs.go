@@ -14,10 +14,28 @@ type FileInfo interface {
 	FullPath() string
 }
 
+// ObjectInfo is implemented by the file info of object stores, whose ReadDir lists every object beneath
+// a directory recursively and names it by its full key.
+type ObjectInfo interface {
+	Key() string
+}
+
 type ListItemLimiter interface {
 	SetMaxListItems(maxList int)
 }
 
+// TruncatingLister is implemented by filesystems whose listings stop at a maximum number of entries, see ListItemLimiter.
+type TruncatingLister interface {
+	// ReadDirTruncated is ReadDir, also reporting whether entries were left out of the listing.
+	ReadDirTruncated(name string) (entries []FileInfo, truncated bool, err error)
+}
+
+// ServerSideEncrypter is implemented by filesystems that encrypt the objects they store, i.e. S3 and GCS.
+type ServerSideEncrypter interface {
+	// SetServerSideEncryption sets the encryption applied to writes, and the customer key used for reads.
+	SetServerSideEncryption(sse *ServerSideEncryption)
+}
+
 type Filesystem interface {
 	Close() error
 	ReadDir(name string) ([]FileInfo, error)
@@ -28,4 +46,33 @@ type FilesystemRW interface {
 	Filesystem
 	Read(ctx gocontext.Context, path string) (io.ReadCloser, error)
 	Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error)
+
+	// Delete removes the file at path.
+	// A missing file is reported with an error satisfying errors.Is(err, os.ErrNotExist).
+	Delete(ctx gocontext.Context, path string) error
+}
+
+// The wrappers of a filesystem forward its optional interfaces with the helpers below,
+// so that wrapping a filesystem does not hide them.
+
+// setMaxListItems limits the listings of fs if it supports it.
+func setMaxListItems(fs Filesystem, max int) {
+	if limiter, ok := fs.(ListItemLimiter); ok {
+		limiter.SetMaxListItems(max)
+	}
+}
+
+// setServerSideEncryption sets the server-side encryption of fs if it supports it.
+func setServerSideEncryption(fs Filesystem, sse *ServerSideEncryption) {
+	if encrypter, ok := fs.(ServerSideEncrypter); ok {
+		encrypter.SetServerSideEncryption(sse)
+	}
+}
+
+// health returns the health of the session of fs, or an empty health if it has none.
+func health(fs Filesystem) SessionHealth {
+	if reporter, ok := fs.(HealthReporter); ok {
+		return reporter.Health()
+	}
+	return SessionHealth{}
 }
@@ -49,6 +49,10 @@ func TestFS(t *testing.T) {
 				t.Fatalf("%v", err)
 			}
 
+			if err := client.fs.Delete(ctx, "missing.txt"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected os.ErrNotExist deleting a missing file, got %v", err)
+			}
+
 			dir := "*"
 			if client.name == "gcsFS" {
 				dir = ""
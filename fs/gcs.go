@@ -2,15 +2,21 @@ package fs
 
 import (
 	gocontext "context"
+	"crypto/md5"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	gcs "cloud.google.com/go/storage"
 	gcpUtil "github.com/flanksource/artifacts/clients/gcp"
 	"github.com/flanksource/duty/connection"
 	"github.com/flanksource/duty/context"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -18,6 +24,12 @@ import (
 type gcsFS struct {
 	*gcs.Client
 	Bucket string
+
+	// maxObjects is the number of objects a listing stops at, see SetMaxListItems. Zero lists every object.
+	maxObjects int
+
+	// encryption is the server-side encryption applied to writes, and its customer key to reads.
+	encryption *ServerSideEncryption
 }
 
 func NewGCSFS(ctx context.Context, bucket string, conn connection.GCSConnection) (*gcsFS, error) {
@@ -34,23 +46,65 @@ func NewGCSFS(ctx context.Context, bucket string, conn connection.GCSConnection)
 	return &fs, nil
 }
 
+func (t *gcsFS) SetMaxListItems(max int) {
+	t.maxObjects = max
+}
+
+func (t *gcsFS) SetServerSideEncryption(sse *ServerSideEncryption) {
+	t.encryption = sse
+}
+
+// object returns the handle of the object at path, using the customer key of sse if any.
+func (t *gcsFS) object(path string, sse *ServerSideEncryption) *gcs.ObjectHandle {
+	obj := t.Client.Bucket(t.Bucket).Object(path)
+	if sse != nil && len(sse.CustomerKey) > 0 {
+		obj = obj.Key(sse.CustomerKey)
+	}
+
+	return obj
+}
+
 func (t *gcsFS) Close() error {
 	return t.Client.Close()
 }
 
+// ReadDir lists the objects beneath the directory recursively.
+// At most the number of objects set with SetMaxListItems are listed.
 func (t *gcsFS) ReadDir(name string) ([]FileInfo, error) {
+	output, _, err := t.ReadDirTruncated(name)
+	return output, err
+}
+
+// ReadDirTruncated is ReadDir, also reporting whether objects were left out because of SetMaxListItems.
+func (t *gcsFS) ReadDirTruncated(name string) ([]FileInfo, bool, error) {
+	// only the objects beneath the directory, not those that merely share its name as a prefix
+	prefix := strings.TrimSuffix(name, "/")
+	if prefix == "." || prefix == "" {
+		prefix = ""
+	} else {
+		prefix += "/"
+	}
+
 	bucket := t.Client.Bucket(t.Bucket)
-	objs := bucket.Objects(gocontext.TODO(), &gcs.Query{Prefix: name})
+	objs := bucket.Objects(gocontext.TODO(), &gcs.Query{Prefix: prefix})
+	if t.maxObjects > 0 {
+		// a page holds no more objects than are listed, so a small listing is a single request
+		objs.PageInfo().MaxSize = t.maxObjects
+	}
 
 	var output []FileInfo
 	for {
+		if t.maxObjects > 0 && len(output) >= t.maxObjects {
+			return output, objs.PageInfo().Remaining() > 0 || objs.PageInfo().Token != "", nil
+		}
+
 		obj, err := objs.Next()
 		if err != nil {
 			if errors.Is(err, iterator.Done) {
 				break
 			}
 
-			return nil, err
+			return nil, false, err
 		}
 
 		if obj == nil {
@@ -61,13 +115,16 @@ func (t *gcsFS) ReadDir(name string) ([]FileInfo, error) {
 		output = append(output, file)
 	}
 
-	return output, nil
+	return output, false, nil
 }
 
 func (t *gcsFS) Stat(path string) (os.FileInfo, error) {
-	obj := t.Client.Bucket(t.Bucket).Object(path)
+	obj := t.object(path, t.encryption)
 	attrs, err := obj.Attrs(gocontext.TODO())
 	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return nil, notExistError{err: err}
+		}
 		return nil, err
 	}
 
@@ -79,18 +136,44 @@ func (t *gcsFS) Stat(path string) (os.FileInfo, error) {
 }
 
 func (t *gcsFS) Read(ctx gocontext.Context, path string) (io.ReadCloser, error) {
-	obj := t.Client.Bucket(t.Bucket).Object(path)
+	obj := t.object(path, t.encryption)
 
 	reader, err := obj.NewReader(ctx)
 	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return nil, notExistError{err: err}
+		}
 		return nil, err
 	}
 
-	return reader, nil
+	return readTransfer(ctx, reader, func() int64 { return reader.Attrs.Size }), nil
 }
 
 func (t *gcsFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
-	obj := t.Client.Bucket(t.Bucket).Object(path)
+	opts := GetWriteOptions(ctx)
+	if opts.Mode == WriteRenameWithSuffix {
+		return writeWithSuffix(ctx, t, path, data)
+	}
+
+	sse, err := writeEncryption(t.encryption, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := t.object(path, sse)
+	switch opts.Mode {
+	case "", WriteOverwrite:
+	case WriteFailIfExists:
+		obj = obj.If(gcs.Conditions{DoesNotExist: true})
+	case WriteIfMatch:
+		generation, err := strconv.ParseInt(opts.IfMatch, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("write mode if-match requires a generation: %w", err)
+		}
+		obj = obj.If(gcs.Conditions{GenerationMatch: generation})
+	default:
+		return nil, fmt.Errorf("%w: write mode %s", errors.ErrUnsupported, opts.Mode)
+	}
 
 	content, err := io.ReadAll(data)
 	if err != nil {
@@ -98,13 +181,57 @@ func (t *gcsFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.Fi
 	}
 
 	writer := obj.NewWriter(ctx)
-	if _, err := writer.Write(content); err != nil {
+	if sse != nil && sse.KMSKeyID != "" {
+		writer.KMSKeyName = sse.KMSKeyID
+	}
+	writer.Metadata = opts.Metadata
+
+	// The content is buffered, so the checksum is known before the upload and GCS validates it
+	switch strings.ToUpper(opts.ChecksumAlgorithm) {
+	case "CRC32C":
+		writer.CRC32C = crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli))
+		writer.SendCRC32C = true
+	case "MD5":
+		sum := md5.Sum(content)
+		writer.MD5 = sum[:]
+	}
+
+	if _, err := io.Copy(writer, writeParts(ctx, int64(len(content)))(content)); err != nil {
 		return nil, err
 	}
 
 	if err := writer.Close(); err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+			return nil, conditionFailed(opts.Mode, err)
+		}
 		return nil, err
 	}
 
-	return t.Stat(path)
+	return &gcpUtil.GCSFileInfo{Object: writer.Attrs()}, nil
+}
+
+func (t *gcsFS) Delete(ctx gocontext.Context, path string) error {
+	err := t.Client.Bucket(t.Bucket).Object(path).Delete(ctx)
+	if errors.Is(err, gcs.ErrObjectNotExist) {
+		return notExistError{err: err}
+	}
+
+	return err
+}
+
+// isRetryableGCS reports whether err is a GCS error the storage client itself considers transient.
+func isRetryableGCS(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return gcs.ShouldRetry(err)
+	}
+
+	return false
+}
+
+// isAuthErrorGCS reports whether GCS rejected the credentials.
+func isAuthErrorGCS(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized
 }
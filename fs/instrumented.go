@@ -0,0 +1,191 @@
+package fs
+
+import (
+	gocontext "context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flanksource/duty/context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentedFS implements FilesystemRW, tracing and measuring every operation of another filesystem.
+//
+// Every operation gets a span with the backend, path, bytes transferred and result, and is recorded in:
+//   - artifacts_fs_operation_duration: latency by backend, operation and result
+//   - artifacts_fs_bytes_read_total, artifacts_fs_bytes_written_total: bytes transferred by backend
+//   - artifacts_fs_errors_total: errors by backend, operation and type, see ErrorType
+type instrumentedFS struct {
+	FilesystemRW
+	ctx     context.Context
+	backend string
+}
+
+// NewInstrumentedFS instruments fs, labelling its spans and metrics with backend, e.g. s3 or sftp.
+// Stat and ReadDir take no context: they are traced in root spans rather than under the span of ctx,
+// which has usually ended long before. ctx only provides the tracer.
+func NewInstrumentedFS(ctx context.Context, fs FilesystemRW, backend string) *instrumentedFS {
+	return &instrumentedFS{FilesystemRW: fs, ctx: ctx, backend: backend}
+}
+
+// ErrorType classifies an error for metrics: not_found, already_exists, precondition_failed,
+// unreachable, authentication, canceled, timeout or other.
+func ErrorType(err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return "not_found"
+	case errors.Is(err, ErrAlreadyExists):
+		return "already_exists"
+	case errors.Is(err, ErrPreconditionFailed):
+		return "precondition_failed"
+	case IsUnreachable(err):
+		return "unreachable"
+	case IsAuthenticationError(err):
+		return "authentication"
+	case errors.Is(err, gocontext.Canceled):
+		return "canceled"
+	case errors.Is(err, gocontext.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "other"
+	}
+}
+
+func (t *instrumentedFS) start(ctx gocontext.Context, operation, path string) (context.Context, trace.Span) {
+	dutyCtx, ok := ctx.(context.Context)
+	if !ok {
+		dutyCtx = t.ctx.Wrap(ctx)
+	}
+
+	spanCtx, span := dutyCtx.StartSpan("fs." + operation)
+	span.SetAttributes(attribute.String("fs.backend", t.backend), attribute.String("fs.path", path))
+	return spanCtx, span
+}
+
+// end records the outcome of an operation that started at start.
+func (t *instrumentedFS) end(span trace.Span, operation string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		t.ctx.Counter("artifacts_fs_errors_total", "backend", t.backend, "operation", operation, "type", ErrorType(err)).Add(1)
+	}
+	span.SetAttributes(attribute.String("fs.result", result))
+	span.End()
+
+	t.ctx.Histogram("artifacts_fs_operation_duration", context.LatencyBuckets,
+		"backend", t.backend, "operation", operation, "result", result).Since(start)
+}
+
+func (t *instrumentedFS) Stat(path string) (os.FileInfo, error) {
+	start := time.Now()
+	_, span := t.start(gocontext.Background(), "Stat", path)
+
+	info, err := t.FilesystemRW.Stat(path)
+	t.end(span, "Stat", start, err)
+	return info, err
+}
+
+func (t *instrumentedFS) ReadDir(name string) ([]FileInfo, error) {
+	start := time.Now()
+	_, span := t.start(gocontext.Background(), "ReadDir", name)
+
+	files, err := t.FilesystemRW.ReadDir(name)
+	span.SetAttributes(attribute.Int("fs.files", len(files)))
+	t.end(span, "ReadDir", start, err)
+	return files, err
+}
+
+func (t *instrumentedFS) ReadDirTruncated(name string) ([]FileInfo, bool, error) {
+	start := time.Now()
+	_, span := t.start(gocontext.Background(), "ReadDir", name)
+
+	files, truncated, err := readDir(t.FilesystemRW, name)
+	span.SetAttributes(attribute.Int("fs.files", len(files)), attribute.Bool("fs.truncated", truncated))
+	t.end(span, "ReadDir", start, err)
+	return files, truncated, err
+}
+
+// Read is traced until the returned reader is closed, so that its span covers the transfer.
+func (t *instrumentedFS) Read(ctx gocontext.Context, path string) (io.ReadCloser, error) {
+	start := time.Now()
+	ctx, span := t.start(ctx, "Read", path)
+
+	reader, err := t.FilesystemRW.Read(ctx, path)
+	if err != nil {
+		t.end(span, "Read", start, err)
+		return nil, err
+	}
+
+	return &instrumentedReader{ReadCloser: reader, fs: t, span: span, start: start}, nil
+}
+
+func (t *instrumentedFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
+	start := time.Now()
+	ctx, span := t.start(ctx, "Write", path)
+
+	info, err := t.FilesystemRW.Write(ctx, path, data)
+	if err == nil {
+		span.SetAttributes(attribute.Int64("fs.bytes", info.Size()))
+		t.ctx.Counter("artifacts_fs_bytes_written_total", "backend", t.backend).Add(int(info.Size()))
+	}
+	t.end(span, "Write", start, err)
+	return info, err
+}
+
+func (t *instrumentedFS) Delete(ctx gocontext.Context, path string) error {
+	start := time.Now()
+	ctx, span := t.start(ctx, "Delete", path)
+
+	err := t.FilesystemRW.Delete(ctx, path)
+	t.end(span, "Delete", start, err)
+	return err
+}
+
+type instrumentedReader struct {
+	io.ReadCloser
+	fs    *instrumentedFS
+	span  trace.Span
+	start time.Time
+
+	n    int64
+	err  error
+	once sync.Once
+}
+
+func (t *instrumentedReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.n += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		t.err = err
+	}
+	return n, err
+}
+
+func (t *instrumentedReader) Close() error {
+	err := t.ReadCloser.Close()
+	t.once.Do(func() {
+		t.span.SetAttributes(attribute.Int64("fs.bytes", t.n))
+		t.fs.ctx.Counter("artifacts_fs_bytes_read_total", "backend", t.fs.backend).Add(int(t.n))
+		t.fs.end(t.span, "Read", t.start, errors.Join(t.err, err))
+	})
+	return err
+}
+
+func (t *instrumentedFS) SetMaxListItems(max int) {
+	setMaxListItems(t.FilesystemRW, max)
+}
+
+func (t *instrumentedFS) SetServerSideEncryption(sse *ServerSideEncryption) {
+	setServerSideEncryption(t.FilesystemRW, sse)
+}
+
+func (t *instrumentedFS) Health() SessionHealth {
+	return health(t.FilesystemRW)
+}
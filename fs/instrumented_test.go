@@ -0,0 +1,162 @@
+package fs
+
+import (
+	gocontext "context"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"strings"
+	"testing"
+
+	commons "github.com/flanksource/commons/context"
+	"github.com/flanksource/duty/context"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// metricValue sums the counters, or the histogram sample counts, of a metric with the given labels.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var value float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			values := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				values[label.GetName()] = label.GetValue()
+			}
+			for k, v := range labels {
+				if values[k] != v {
+					continue metrics
+				}
+			}
+			value += metric.GetCounter().GetValue() + float64(metric.GetHistogram().GetSampleCount())
+		}
+	}
+	return value
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func TestInstrumentedFS(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer func() { _ = provider.Shutdown(gocontext.TODO()) }()
+
+	// the filesystem is opened under a span that ends long before it is used
+	ctx, parent := context.NewContext(gocontext.TODO(), commons.WithTracer(provider.Tracer("test"))).StartSpan("open")
+	parent.End()
+
+	const backend = "instrumented-test"
+	fs := NewInstrumentedFS(ctx, NewLocalFS(t.TempDir()), backend)
+
+	if _, err := fs.Write(ctx, "a.txt", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := fs.Read(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		t.Fatal(err)
+	}
+	_ = reader.Close()
+	if _, err := fs.Stat("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadDir(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete(ctx, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("a.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the deleted file to be missing, got %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		attributes map[attribute.Key]attribute.Value
+		failed     bool
+		root       bool
+	}{
+		{name: "fs.Write", attributes: map[attribute.Key]attribute.Value{"fs.bytes": attribute.Int64Value(7)}},
+		{name: "fs.Read", attributes: map[attribute.Key]attribute.Value{"fs.bytes": attribute.Int64Value(7)}},
+		{name: "fs.Stat", root: true},
+		{name: "fs.ReadDir", attributes: map[attribute.Key]attribute.Value{"fs.files": attribute.IntValue(1)}, root: true},
+		{name: "fs.Delete"},
+		{name: "fs.Stat", failed: true, root: true},
+	}
+
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() != "open" {
+			spans = append(spans, span)
+		}
+	}
+	if len(spans) != len(tests) {
+		t.Fatalf("expected %d spans, got %d", len(tests), len(spans))
+	}
+
+	for i, test := range tests {
+		span := spans[i]
+		if span.Name() != test.name {
+			t.Errorf("expected span %d to be %s, got %s", i, test.name, span.Name())
+			continue
+		}
+
+		result := "ok"
+		if test.failed {
+			result = "error"
+		}
+		expected := map[attribute.Key]attribute.Value{"fs.backend": attribute.StringValue(backend), "fs.result": attribute.StringValue(result)}
+		maps.Copy(expected, test.attributes)
+
+		attributes := spanAttributes(span)
+		for k, v := range expected {
+			if attributes[k] != v {
+				t.Errorf("%s: expected %s=%s, got %s", test.name, k, v.Emit(), attributes[k].Emit())
+			}
+		}
+
+		if failed := span.Status().Code == codes.Error; failed != test.failed {
+			t.Errorf("%s: expected an error status %v, got %v", test.name, test.failed, span.Status())
+		}
+		if root := !span.Parent().IsValid(); root != test.root {
+			t.Errorf("%s: expected a root span %v, got a parent %v", test.name, test.root, span.Parent().SpanID())
+		}
+	}
+
+	for operation, count := range map[string]float64{"Write": 1, "Read": 1, "Stat": 2, "ReadDir": 1, "Delete": 1} {
+		if value := metricValue(t, "artifacts_fs_operation_duration", map[string]string{"backend": backend, "operation": operation}); value != count {
+			t.Errorf("expected %v %s durations, got %v", count, operation, value)
+		}
+	}
+	if value := metricValue(t, "artifacts_fs_bytes_written_total", map[string]string{"backend": backend}); value != 7 {
+		t.Errorf("expected 7 bytes written, got %v", value)
+	}
+	if value := metricValue(t, "artifacts_fs_bytes_read_total", map[string]string{"backend": backend}); value != 7 {
+		t.Errorf("expected 7 bytes read, got %v", value)
+	}
+	if value := metricValue(t, "artifacts_fs_errors_total", map[string]string{"backend": backend, "operation": "Stat", "type": "not_found"}); value != 1 {
+		t.Errorf("expected 1 not_found error, got %v", value)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	gocontext "context"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
 	"strings"
@@ -84,27 +85,80 @@ func (t *localFS) Stat(name string) (os.FileInfo, error) {
 }
 
 func (t *localFS) Read(ctx gocontext.Context, path string) (io.ReadCloser, error) {
-	return os.Open(filepath.Join(t.base, path))
+	file, err := os.Open(filepath.Join(t.base, path))
+	if err != nil {
+		return nil, err
+	}
+
+	return readTransfer(ctx, file, fileSize(file)), nil
 }
 
 func (t *localFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
+	opts := GetWriteOptions(ctx)
+	if opts.Mode == WriteRenameWithSuffix {
+		return writeWithSuffix(ctx, t, path, data)
+	}
+	data = writeTransfer(ctx, data)
+
+	flags, err := openFlags(opts.Mode)
+	if err != nil {
+		return nil, err
+	}
+
 	fullpath := filepath.Join(t.base, path)
 
 	// Ensure the directory exists
-	err := os.MkdirAll(filepath.Dir(fullpath), os.ModePerm)
+	err = os.MkdirAll(filepath.Dir(fullpath), os.ModePerm)
 	if err != nil {
 		return nil, fmt.Errorf("error creating base directory: %w", err)
 	}
 
-	f, err := os.Create(fullpath)
-	if err != nil {
+	if opts.Mode == WriteFailIfExists {
+		f, err := os.OpenFile(fullpath, flags, 0666)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = f.Close() }()
+
+		if _, err := io.Copy(f, data); err != nil {
+			// the file was created by this write
+			_ = os.Remove(fullpath)
+			return nil, err
+		}
+		return t.Stat(path)
+	}
+
+	if err := writeAtomic(fullpath, data); err != nil {
 		return nil, err
 	}
 
+	return t.Stat(path)
+}
+
+// writeAtomic replaces the file with the content written to a temporary file next to it,
+// so that a failed write leaves the existing file as it was.
+func writeAtomic(fullpath string, data io.Reader) error {
+	temp := fmt.Sprintf("%s.%d.tmp", fullpath, rand.Uint64())
+	f, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
 	_, err = io.Copy(f, data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, fullpath)
+	}
 	if err != nil {
-		return nil, err
+		_ = os.Remove(temp)
+		return err
 	}
 
-	return t.Stat(path)
+	return nil
+}
+
+func (t *localFS) Delete(ctx gocontext.Context, path string) error {
+	return os.Remove(filepath.Join(t.base, path))
 }
@@ -0,0 +1,152 @@
+package fs
+
+import (
+	"bytes"
+	gocontext "context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+
+	"github.com/samber/lo"
+	"golang.org/x/time/rate"
+)
+
+// ServerSideEncryption configures the encryption applied by the storage service to the objects it stores.
+// It is supported by the S3 and GCS filesystems.
+type ServerSideEncryption struct {
+	// Algorithm is the S3 server-side encryption: AES256, aws:kms or aws:kms:dsse.
+	// Defaults to aws:kms when KMSKeyID is set. It is not used by GCS.
+	Algorithm string
+
+	// KMSKeyID is the KMS key used with aws:kms on S3, or the Cloud KMS key name (CMEK) on GCS.
+	KMSKeyID string
+
+	// CustomerKey is a customer-provided 256-bit key (SSE-C on S3, CSEK on GCS).
+	// Objects written with it can only be read with the same key.
+	CustomerKey []byte
+}
+
+// ErrCustomerKeyOverride is returned by a write whose ServerSideEncryption override has a customer key other than
+// the filesystem's. Reads and stats use the filesystem's key, so the object could not be read back.
+var ErrCustomerKeyOverride = errors.New("the customer key of a write cannot differ from the filesystem's")
+
+// writeEncryption returns the encryption of a write: the override of the write options, or the filesystem's.
+func writeEncryption(sse *ServerSideEncryption, opts WriteOptions) (*ServerSideEncryption, error) {
+	override := opts.ServerSideEncryption
+	if override == nil {
+		return sse, nil
+	}
+
+	var customerKey []byte
+	if sse != nil {
+		customerKey = sse.CustomerKey
+	}
+	if !bytes.Equal(override.CustomerKey, customerKey) {
+		return nil, ErrCustomerKeyOverride
+	}
+
+	return override, nil
+}
+
+// s3Algorithm returns the S3 server-side encryption algorithm, aws:kms when only a KMS key is set.
+func (t *ServerSideEncryption) s3Algorithm() string {
+	if t.Algorithm == "" && t.KMSKeyID != "" {
+		return "aws:kms"
+	}
+
+	return t.Algorithm
+}
+
+func (t *ServerSideEncryption) customerKeyHeaders() (algorithm, key, keyMD5 *string) {
+	if t == nil || len(t.CustomerKey) == 0 {
+		return nil, nil, nil
+	}
+
+	sum := md5.Sum(t.CustomerKey)
+	return lo.ToPtr("AES256"), lo.ToPtr(base64.StdEncoding.EncodeToString(t.CustomerKey)), lo.ToPtr(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// EncryptionInfo is implemented by the file info of backends that report server-side encryption.
+type EncryptionInfo interface {
+	// ServerSideEncryption returns the encryption applied to the object and the key it was encrypted with.
+	// Customer-provided keys are never reported.
+	ServerSideEncryption() (algorithm string, keyID string)
+}
+
+// MetadataInfo is implemented by the file info of backends that store user-defined metadata with an object.
+type MetadataInfo interface {
+	// UserMetadata returns the metadata written with WriteOptions.Metadata.
+	UserMetadata() map[string]string
+}
+
+// WriteMode decides what a Write does when something is already stored at the path.
+type WriteMode string
+
+const (
+	// WriteOverwrite replaces existing content. It is the default.
+	// S3, GCS and local files keep the existing content when the write fails; SFTP and SMB overwrite it in place.
+	WriteOverwrite WriteMode = "overwrite"
+
+	// WriteFailIfExists fails with ErrAlreadyExists if something is stored at the path.
+	// A write that fails part way removes the file it created.
+	WriteFailIfExists WriteMode = "fail-if-exists"
+
+	// WriteRenameWithSuffix writes to the first free path with a numeric suffix, see UniquePath.
+	// The path written to is the one of the returned file info.
+	WriteRenameWithSuffix WriteMode = "rename-with-suffix"
+
+	// WriteIfMatch only replaces the content if its version is WriteOptions.IfMatch,
+	// failing with ErrPreconditionFailed otherwise. It is supported by S3 and GCS.
+	WriteIfMatch WriteMode = "if-match"
+)
+
+// VersionInfo is implemented by the file info of backends that support WriteIfMatch.
+type VersionInfo interface {
+	// Version returns the value to pass as WriteOptions.IfMatch: the ETag on S3, the generation on GCS.
+	Version() string
+}
+
+type writeOptionsKey struct{}
+
+// WriteOptions adjust a single Write call.
+// They are passed to Write through its context, see WithWriteOptions.
+type WriteOptions struct {
+	// ServerSideEncryption overrides the filesystem's server-side encryption for this write.
+	// Its customer key must be the filesystem's, see ErrCustomerKeyOverride.
+	ServerSideEncryption *ServerSideEncryption
+
+	// ChecksumAlgorithm asks the storage service to validate the upload with a checksum
+	// computed while the content is sent: CRC32, CRC32C, SHA1, SHA256 or CRC64NVME on S3, CRC32C or MD5 on GCS.
+	// Other backends and unsupported algorithms ignore it.
+	ChecksumAlgorithm string
+
+	// Metadata is stored with the object as user-defined metadata on S3 and GCS.
+	// Other backends ignore it.
+	Metadata map[string]string
+
+	// Mode decides what happens when something is already stored at the path. Defaults to WriteOverwrite.
+	Mode WriteMode
+
+	// IfMatch is the version the content must have for a write with WriteIfMatch, see VersionInfo.
+	IfMatch string
+
+	// Progress is called as the content is sent.
+	Progress ProgressFunc
+
+	// Limiter throttles sending the content, see NewBandwidthLimiter.
+	Limiter *rate.Limiter
+}
+
+// WithWriteOptions returns a context that applies opts to the Write calls made with it.
+func WithWriteOptions(ctx gocontext.Context, opts WriteOptions) gocontext.Context {
+	return gocontext.WithValue(ctx, writeOptionsKey{}, opts)
+}
+
+// GetWriteOptions returns the write options carried by ctx.
+func GetWriteOptions(ctx gocontext.Context) WriteOptions {
+	if opts, ok := ctx.Value(writeOptionsKey{}).(WriteOptions); ok {
+		return opts
+	}
+
+	return WriteOptions{}
+}
@@ -0,0 +1,448 @@
+package fs
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultReplicationInterval = 10 * time.Second
+
+// ReplicationMode decides whether a write waits for its replicas.
+type ReplicationMode string
+
+const (
+	// ReplicateAsync returns once the file is on the primary and queues it for the replicas. It is the default.
+	ReplicateAsync ReplicationMode = "async"
+
+	// ReplicateSync returns once the file is on the primary and every replica it could be replicated to.
+	// A replica that fails is retried from the queue, like in async mode.
+	ReplicateSync ReplicationMode = "sync"
+)
+
+// ErrReplicationFailed is returned by a write or delete that succeeded on the primary but could not be queued
+// for a replica, so that the replica will not be brought in sync.
+//
+// A synchronous replication that fails is not an error of the write: it is queued to be retried,
+// reported to ReplicationOptions.OnReplicate and by Status.
+var ErrReplicationFailed = errors.New("replication failed")
+
+// Replica is a secondary filesystem files are replicated to.
+type Replica struct {
+	// Name identifies the replica in the replication queue, so it must stay the same across restarts.
+	Name string
+	FS   FilesystemRW
+}
+
+type ReplicationOptions struct {
+	// Mode defaults to ReplicateAsync.
+	Mode ReplicationMode
+
+	// Queue holds the replications that are pending or failed. Defaults to NewMemoryReplicationQueue;
+	// use NewFileReplicationQueue for replications to survive a restart.
+	Queue ReplicationQueue
+
+	// Interval is how often the queue is checked for replications to retry. Defaults to 10s.
+	Interval time.Duration
+
+	// Backoff is the delay between the attempts of a failed replication. Only its backoff and jitter are used:
+	// a replication is retried until it succeeds.
+	Backoff RetryOptions
+
+	// OnReplicate is called after every attempt to replicate a file, with a nil error when it succeeded,
+	// e.g. to record the replication status.
+	OnReplicate func(task ReplicationTask, err error)
+}
+
+// ReplicaState is the replication state of a file on a replica.
+type ReplicaState string
+
+const (
+	ReplicaInSync ReplicaState = "in_sync"
+
+	// ReplicaPending is a replication that is queued or being retried.
+	ReplicaPending ReplicaState = "pending"
+)
+
+// ReplicaStatus is the replication status of a file on a replica.
+type ReplicaStatus struct {
+	Replica string
+	State   ReplicaState
+
+	// Task is the queued replication when the state is ReplicaPending.
+	Task *ReplicationTask
+}
+
+// replicatedFS implements FilesystemRW, replicating the writes and deletes of a primary filesystem to replicas.
+//
+// The primary is the source of truth: writes and deletes must succeed on it, and a replica is brought
+// in sync by copying the file from the primary. Replications that fail are retried from the queue in the
+// background with backoff, and a newer change of the same file replaces a queued one.
+//
+// Reads, Stat and ReadDir fall back to the replicas when the primary fails with anything other than a missing file.
+// A replica with a pending replication of the file, or of any file under the listed directory, is skipped as it
+// may be stale.
+type replicatedFS struct {
+	primary  FilesystemRW
+	replicas []Replica
+	opts     ReplicationOptions
+
+	draining sync.Mutex
+	notify   chan struct{}
+	cancel   gocontext.CancelFunc
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewReplicatedFS replicates primary to the replicas and starts retrying the queued replications,
+// until the filesystem is closed.
+func NewReplicatedFS(primary FilesystemRW, replicas []Replica, opts ReplicationOptions) *replicatedFS {
+	if opts.Mode == "" {
+		opts.Mode = ReplicateAsync
+	}
+	if opts.Queue == nil {
+		opts.Queue = NewMemoryReplicationQueue()
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultReplicationInterval
+	}
+	opts.Backoff = opts.Backoff.withDefaults()
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	t := &replicatedFS{
+		primary:  primary,
+		replicas: replicas,
+		opts:     opts,
+		notify:   make(chan struct{}, 1),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go t.run(ctx)
+	return t
+}
+
+func (t *replicatedFS) Write(ctx gocontext.Context, p string, data io.Reader) (os.FileInfo, error) {
+	info, err := t.primary.Write(ctx, p, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if GetWriteOptions(ctx).Mode == WriteRenameWithSuffix {
+		p = path.Join(path.Dir(p), path.Base(info.Name()))
+	}
+
+	return info, t.replicate(ctx, ReplicateWrite, p, GetWriteOptions(ctx).Metadata)
+}
+
+func (t *replicatedFS) Delete(ctx gocontext.Context, p string) error {
+	err := t.primary.Delete(ctx, p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// a file missing on the primary may still be on a replica
+	return errors.Join(err, t.replicate(ctx, ReplicateDelete, p, nil))
+}
+
+// replicate replicates a change of the primary to every replica: right away in sync mode, falling back to the queue,
+// or through the queue in async mode. It only fails when a replication could not be queued.
+func (t *replicatedFS) replicate(ctx gocontext.Context, op ReplicationOp, p string, metadata map[string]string) error {
+	now := time.Now()
+
+	var errs []error
+	for _, replica := range t.replicas {
+		task := ReplicationTask{Replica: replica.Name, Path: p, Op: op, Metadata: metadata, NextAttempt: now, CreatedAt: now}
+		if t.opts.Mode == ReplicateSync {
+			err := t.apply(ctx, replica, task)
+			if t.opts.OnReplicate != nil {
+				t.opts.OnReplicate(task, err)
+			}
+			if err == nil {
+				continue
+			}
+
+			task.Attempts = 1
+			task.LastError = err.Error()
+			task.NextAttempt = now.Add(t.opts.Backoff.delay(1))
+		}
+
+		if err := t.opts.Queue.Push(task); err != nil {
+			errs = append(errs, fmt.Errorf("%w: error queueing replication to replica(%s): %w", ErrReplicationFailed, replica.Name, err))
+		}
+	}
+
+	if t.opts.Mode == ReplicateAsync {
+		select {
+		case t.notify <- struct{}{}:
+		default:
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// apply brings the file of the task on the replica in sync with the primary.
+func (t *replicatedFS) apply(ctx gocontext.Context, replica Replica, task ReplicationTask) error {
+	if task.Op == ReplicateDelete {
+		return ignoreNotExist(replica.FS.Delete(ctx, task.Path))
+	}
+
+	// progress is only reported for the primary
+	readOptions := GetReadOptions(ctx)
+	readOptions.Progress = nil
+
+	reader, err := t.primary.Read(WithReadOptions(ctx, readOptions), task.Path)
+	if err != nil {
+		// the file was deleted since, which is replicated by its own task
+		return ignoreNotExist(err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	writeOptions := WriteOptions{Metadata: task.Metadata, Limiter: GetWriteOptions(ctx).Limiter}
+	_, err = replica.FS.Write(WithWriteOptions(ctx, writeOptions), task.Path, reader)
+	return err
+}
+
+// run retries the queued replications until the filesystem is closed.
+func (t *replicatedFS) run(ctx gocontext.Context) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		_, _ = t.Drain(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-t.notify:
+		}
+	}
+}
+
+// Drain attempts every queued replication that is due, and returns the number of replications still queued.
+// Errors updating the queue are returned once every replication was attempted.
+// Drains are serialized, so that a replication is not attempted twice at once.
+func (t *replicatedFS) Drain(ctx gocontext.Context) (int, error) {
+	t.draining.Lock()
+	defer t.draining.Unlock()
+
+	tasks, err := t.opts.Queue.List()
+	if err != nil {
+		return 0, fmt.Errorf("error listing replication queue: %w", err)
+	}
+
+	slices.SortFunc(tasks, func(a, b ReplicationTask) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	pending := 0
+	var errs []error
+	for _, task := range tasks {
+		if ctx.Err() != nil {
+			return pending + 1, errors.Join(append(errs, ctx.Err())...)
+		}
+
+		replica, ok := t.replica(task.Replica)
+		if !ok {
+			continue // a replica that was removed from the configuration
+		}
+
+		if task.NextAttempt.After(time.Now()) {
+			pending++
+			continue
+		}
+
+		err := t.apply(ctx, replica, task)
+		if t.opts.OnReplicate != nil {
+			t.opts.OnReplicate(task, err)
+		}
+
+		if err == nil {
+			if err := t.opts.Queue.Remove(task); err != nil {
+				errs = append(errs, fmt.Errorf("error removing replication of %s to replica(%s): %w", task.Path, task.Replica, err))
+			}
+			continue
+		}
+
+		pending++
+		task.Attempts++
+		task.LastError = err.Error()
+		task.NextAttempt = time.Now().Add(t.opts.Backoff.delay(task.Attempts))
+		if err := t.opts.Queue.Update(task); err != nil {
+			errs = append(errs, fmt.Errorf("error updating replication of %s to replica(%s): %w", task.Path, task.Replica, err))
+		}
+	}
+
+	return pending, errors.Join(errs...)
+}
+
+func (t *replicatedFS) replica(name string) (Replica, bool) {
+	for _, replica := range t.replicas {
+		if replica.Name == name {
+			return replica, true
+		}
+	}
+	return Replica{}, false
+}
+
+// Status returns the replication status of a file on every replica.
+func (t *replicatedFS) Status(p string) ([]ReplicaStatus, error) {
+	pending, err := t.pending(p)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]ReplicaStatus, 0, len(t.replicas))
+	for _, replica := range t.replicas {
+		status := ReplicaStatus{Replica: replica.Name, State: ReplicaInSync}
+		if task, ok := pending[replica.Name]; ok {
+			status.State = ReplicaPending
+			status.Task = &task
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// pending returns the queued replications of a file by replica.
+func (t *replicatedFS) pending(p string) (map[string]ReplicationTask, error) {
+	return t.pendingOf(isPath(p))
+}
+
+// pendingOf returns a queued replication by replica of the files that match.
+func (t *replicatedFS) pendingOf(match func(p string) bool) (map[string]ReplicationTask, error) {
+	tasks, err := t.opts.Queue.List()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := map[string]ReplicationTask{}
+	for _, task := range tasks {
+		if match(task.Path) {
+			pending[task.Replica] = task
+		}
+	}
+	return pending, nil
+}
+
+// isPath matches the file p.
+func isPath(p string) func(string) bool {
+	return func(file string) bool { return file == p }
+}
+
+// isUnder matches the files under dir, at any depth.
+func isUnder(dir string) func(string) bool {
+	dir = path.Clean(dir)
+	return func(file string) bool {
+		return dir == "." || dir == "/" || strings.HasPrefix(path.Clean(file), dir+"/")
+	}
+}
+
+// fallback tries op on the replicas without a pending replication of the files that match,
+// after it failed on the primary.
+func fallback[T any](t *replicatedFS, match func(p string) bool, primaryErr error, op func(fs FilesystemRW) (T, error)) (T, error) {
+	var zero T
+	if errors.Is(primaryErr, os.ErrNotExist) {
+		return zero, primaryErr
+	}
+
+	stale, err := t.pendingOf(match)
+	if err != nil {
+		return zero, primaryErr
+	}
+
+	for _, replica := range t.replicas {
+		if _, ok := stale[replica.Name]; ok {
+			continue
+		}
+
+		if result, err := op(replica.FS); err == nil {
+			return result, nil
+		}
+	}
+
+	return zero, primaryErr
+}
+
+func (t *replicatedFS) Read(ctx gocontext.Context, p string) (io.ReadCloser, error) {
+	reader, err := t.primary.Read(ctx, p)
+	if err == nil {
+		return reader, nil
+	}
+
+	return fallback(t, isPath(p), err, func(fs FilesystemRW) (io.ReadCloser, error) { return fs.Read(ctx, p) })
+}
+
+func (t *replicatedFS) Stat(p string) (os.FileInfo, error) {
+	info, err := t.primary.Stat(p)
+	if err == nil {
+		return info, nil
+	}
+
+	return fallback(t, isPath(p), err, func(fs FilesystemRW) (os.FileInfo, error) { return fs.Stat(p) })
+}
+
+func (t *replicatedFS) ReadDir(name string) ([]FileInfo, error) {
+	files, err := t.primary.ReadDir(name)
+	if err == nil {
+		return files, nil
+	}
+
+	return fallback(t, isUnder(name), err, func(fs FilesystemRW) ([]FileInfo, error) { return fs.ReadDir(name) })
+}
+
+func (t *replicatedFS) ReadDirTruncated(name string) ([]FileInfo, bool, error) {
+	files, truncated, err := readDir(t.primary, name)
+	if err == nil {
+		return files, truncated, nil
+	}
+
+	files, err = fallback(t, isUnder(name), err, func(fs FilesystemRW) (files []FileInfo, err error) {
+		files, truncated, err = readDir(fs, name)
+		return files, err
+	})
+	return files, truncated, err
+}
+
+// SetMaxListItems limits the listings of the primary and of the replicas, which listings fall back to.
+func (t *replicatedFS) SetMaxListItems(max int) {
+	setMaxListItems(t.primary, max)
+	for _, replica := range t.replicas {
+		setMaxListItems(replica.FS, max)
+	}
+}
+
+// SetServerSideEncryption sets the encryption of the primary. The replicas keep their own.
+func (t *replicatedFS) SetServerSideEncryption(sse *ServerSideEncryption) {
+	setServerSideEncryption(t.primary, sse)
+}
+
+// Health returns the health of the session of the primary.
+func (t *replicatedFS) Health() SessionHealth {
+	return health(t.primary)
+}
+
+// Close stops retrying the queued replications and closes the primary and the replicas.
+// Replications still queued are retried once the filesystem is created again with a durable queue.
+func (t *replicatedFS) Close() error {
+	var errs []error
+	t.once.Do(func() {
+		t.cancel()
+		<-t.done
+
+		errs = append(errs, t.primary.Close())
+		for _, replica := range t.replicas {
+			errs = append(errs, replica.FS.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,250 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicationOp is the operation replicated by a ReplicationTask.
+type ReplicationOp string
+
+const (
+	// ReplicateWrite copies the file from the primary to the replica.
+	ReplicateWrite ReplicationOp = "write"
+
+	// ReplicateDelete removes the file from the replica.
+	ReplicateDelete ReplicationOp = "delete"
+)
+
+// ReplicationTask is a file that is not yet replicated to a replica.
+//
+// A replica has at most one task per path: a newer task replaces the older one,
+// e.g. a delete replaces a pending write.
+type ReplicationTask struct {
+	Replica string        `json:"replica"`
+	Path    string        `json:"path"`
+	Op      ReplicationOp `json:"op"`
+
+	// Metadata is the object metadata the file was written with, see WriteOptions.Metadata.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Attempts is the number of failed attempts to replicate the file.
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+
+	// NextAttempt is the earliest time the task is retried.
+	NextAttempt time.Time `json:"next_attempt"`
+
+	// CreatedAt identifies the version of the task: updates and removals of a task that was replaced since are ignored.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (t ReplicationTask) key() string {
+	return t.Replica + "\x00" + t.Path
+}
+
+// ReplicationQueue holds the replication tasks that are pending or failed.
+type ReplicationQueue interface {
+	// Push adds the task, replacing any task for the same replica and path.
+	Push(task ReplicationTask) error
+
+	// Update stores the state of a task after a failed attempt, unless the task was replaced since.
+	Update(task ReplicationTask) error
+
+	// Remove removes a task once it is replicated, unless the task was replaced since.
+	Remove(task ReplicationTask) error
+
+	// List returns all the tasks in the queue.
+	List() ([]ReplicationTask, error)
+}
+
+// memoryReplicationQueue is a ReplicationQueue that is lost on restart.
+type memoryReplicationQueue struct {
+	mu    sync.Mutex
+	tasks map[string]ReplicationTask
+}
+
+func NewMemoryReplicationQueue() *memoryReplicationQueue {
+	return &memoryReplicationQueue{tasks: map[string]ReplicationTask{}}
+}
+
+func (t *memoryReplicationQueue) Push(task ReplicationTask) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tasks[task.key()] = task
+	return nil
+}
+
+func (t *memoryReplicationQueue) Update(task ReplicationTask) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if current, ok := t.tasks[task.key()]; ok && current.CreatedAt.Equal(task.CreatedAt) {
+		t.tasks[task.key()] = task
+	}
+	return nil
+}
+
+func (t *memoryReplicationQueue) Remove(task ReplicationTask) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if current, ok := t.tasks[task.key()]; ok && current.CreatedAt.Equal(task.CreatedAt) {
+		delete(t.tasks, task.key())
+	}
+	return nil
+}
+
+func (t *memoryReplicationQueue) List() ([]ReplicationTask, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tasks := make([]ReplicationTask, 0, len(t.tasks))
+	for _, task := range t.tasks {
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// fileReplicationQueue is a ReplicationQueue that keeps every task in a JSON file of a local directory,
+// so that pending replications survive a restart.
+//
+// Files are replaced atomically. The directory must not be shared by two processes.
+// A task file that cannot be parsed is renamed with a .corrupt suffix and left out of the queue.
+type fileReplicationQueue struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewFileReplicationQueue(dir string) (*fileReplicationQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating replication queue directory: %w", err)
+	}
+
+	return &fileReplicationQueue{dir: dir}, nil
+}
+
+// errCorruptTask is returned when reading a task file that cannot be parsed.
+var errCorruptTask = errors.New("corrupt replication task")
+
+func (t *fileReplicationQueue) taskFile(task ReplicationTask) string {
+	sum := sha256.Sum256([]byte(task.key()))
+	return filepath.Join(t.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (t *fileReplicationQueue) Push(task ReplicationTask) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.write(task)
+}
+
+func (t *fileReplicationQueue) Update(task ReplicationTask) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if current, err := t.read(t.taskFile(task)); err != nil || !current.CreatedAt.Equal(task.CreatedAt) {
+		return ignoreNotExist(err)
+	}
+	return t.write(task)
+}
+
+func (t *fileReplicationQueue) Remove(task ReplicationTask) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	file := t.taskFile(task)
+	if current, err := t.read(file); err != nil || !current.CreatedAt.Equal(task.CreatedAt) {
+		return ignoreNotExist(err)
+	}
+	return ignoreNotExist(os.Remove(file))
+}
+
+func (t *fileReplicationQueue) List() ([]ReplicationTask, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading replication queue: %w", err)
+	}
+
+	var tasks []ReplicationTask
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		file := filepath.Join(t.dir, entry.Name())
+		task, err := t.read(file)
+		switch {
+		case errors.Is(err, errCorruptTask):
+			// quarantined for inspection, so that it does not hold up the other tasks
+			_ = os.Rename(file, file+".corrupt")
+			continue
+		case errors.Is(err, os.ErrNotExist):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+
+	return tasks, nil
+}
+
+func (t *fileReplicationQueue) read(file string) (ReplicationTask, error) {
+	var task ReplicationTask
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return task, err
+	}
+
+	if err := json.Unmarshal(content, &task); err != nil {
+		return task, fmt.Errorf("%w %s: %w", errCorruptTask, file, err)
+	}
+	return task, nil
+}
+
+func (t *fileReplicationQueue) write(task ReplicationTask) error {
+	content, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(t.dir, ".task-*")
+	if err != nil {
+		return fmt.Errorf("error writing replication task: %w", err)
+	}
+	defer func() { _ = os.Remove(temp.Name()) }()
+
+	if _, err := temp.Write(content); err != nil {
+		_ = temp.Close()
+		return fmt.Errorf("error writing replication task: %w", err)
+	}
+	if err := temp.Sync(); err != nil {
+		_ = temp.Close()
+		return fmt.Errorf("error writing replication task: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("error writing replication task: %w", err)
+	}
+
+	return os.Rename(temp.Name(), t.taskFile(task))
+}
+
+func ignoreNotExist(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,256 @@
+package fs
+
+import (
+	gocontext "context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// unavailableFS fails every operation as if the backend could not be reached.
+type unavailableFS struct {
+	FilesystemRW
+	down bool
+}
+
+func (t *unavailableFS) Read(ctx gocontext.Context, path string) (io.ReadCloser, error) {
+	if t.down {
+		return nil, syscall.ECONNREFUSED
+	}
+	return t.FilesystemRW.Read(ctx, path)
+}
+
+func (t *unavailableFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
+	if t.down {
+		return nil, syscall.ECONNREFUSED
+	}
+	return t.FilesystemRW.Write(ctx, path, data)
+}
+
+func (t *unavailableFS) ReadDir(name string) ([]FileInfo, error) {
+	if t.down {
+		return nil, syscall.ECONNREFUSED
+	}
+	return t.FilesystemRW.ReadDir(name)
+}
+
+func TestReplicatedFS(t *testing.T) {
+	ctx := gocontext.TODO()
+	primary := &unavailableFS{FilesystemRW: NewLocalFS(t.TempDir())}
+	replica := &unavailableFS{FilesystemRW: NewLocalFS(t.TempDir()), down: true}
+
+	queue, err := NewFileReplicationQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replicated := NewReplicatedFS(primary, []Replica{{Name: "dr", FS: replica}}, ReplicationOptions{
+		Mode:     ReplicateSync,
+		Queue:    queue,
+		Interval: time.Hour,
+		Backoff:  RetryOptions{InitialBackoff: time.Nanosecond},
+	})
+	defer replicated.Close()
+
+	// the replication failing is no failure of the write, which is on the primary and queued for the replica
+	if _, err := replicated.Write(ctx, "a.txt", strings.NewReader("content")); err != nil {
+		t.Fatalf("expected the write to succeed, got %v", err)
+	}
+
+	statuses, err := replicated.Status("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].State != ReplicaPending || statuses[0].Task.Attempts != 1 {
+		t.Fatalf("expected a pending replication, got %+v", statuses)
+	}
+
+	replica.down = false
+	if pending, err := replicated.Drain(ctx); err != nil || pending != 0 {
+		t.Fatalf("expected the queue to be drained, got %d pending: %v", pending, err)
+	}
+	if statuses, _ = replicated.Status("a.txt"); statuses[0].State != ReplicaInSync {
+		t.Fatalf("expected the replica to be in sync, got %+v", statuses)
+	}
+
+	primary.down = true
+	reader, err := replicated.Read(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if content, _ := io.ReadAll(reader); string(content) != "content" {
+		t.Errorf("expected to read from the replica, got %q", content)
+	}
+}
+
+// failingQueue fails to remove and update its tasks.
+type failingQueue struct {
+	ReplicationQueue
+}
+
+var errQueueFailed = errors.New("queue failed")
+
+func (t failingQueue) Remove(task ReplicationTask) error { return errQueueFailed }
+func (t failingQueue) Update(task ReplicationTask) error { return errQueueFailed }
+
+func TestReplicationDrainQueueErrors(t *testing.T) {
+	queue := failingQueue{NewMemoryReplicationQueue()}
+	replicated := NewReplicatedFS(NewLocalFS(t.TempDir()), []Replica{{Name: "dr", FS: NewLocalFS(t.TempDir())}}, ReplicationOptions{
+		Queue:    queue,
+		Interval: time.Hour,
+	})
+	defer replicated.Close()
+
+	if err := queue.Push(ReplicationTask{Replica: "dr", Path: "a.txt", Op: ReplicateDelete, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := replicated.Drain(gocontext.TODO()); !errors.Is(err, errQueueFailed) {
+		t.Errorf("expected the queue error to be returned, got %v", err)
+	}
+}
+
+func TestFileReplicationQueueCorruptTask(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := NewFileReplicationQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := queue.Push(ReplicationTask{Replica: "dr", Path: "a.txt", Op: ReplicateWrite, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "corrupt.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err := queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].Path != "a.txt" {
+		t.Errorf("expected the valid task to be listed, got %+v", tasks)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "corrupt.json.corrupt")); err != nil {
+		t.Errorf("expected the corrupt task to be quarantined: %v", err)
+	}
+}
+
+func TestReplicatedFSForwardsOptionalInterfaces(t *testing.T) {
+	s3, requests := newFakeS3(t)
+	var wrapped FilesystemRW = NewReplicatedFS(s3, nil, ReplicationOptions{Interval: time.Hour})
+	defer wrapped.Close()
+
+	limiter, ok := wrapped.(ListItemLimiter)
+	if !ok {
+		t.Fatal("expected the wrapper to forward SetMaxListItems")
+	}
+	limiter.SetMaxListItems(1)
+
+	if _, ok := wrapped.(ServerSideEncrypter); !ok {
+		t.Error("expected the wrapper to forward SetServerSideEncryption")
+	}
+
+	_, truncated, err := wrapped.(TruncatingLister).ReadDirTruncated(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("expected the truncation of the listing to be forwarded")
+	}
+	if query := requests()[0].Query; !strings.Contains(query, "max-keys=1") {
+		t.Errorf("expected the listing limit to reach the filesystem, got %s", query)
+	}
+}
+
+func TestReplicatedFSStaleListing(t *testing.T) {
+	ctx := gocontext.TODO()
+	primary := &unavailableFS{FilesystemRW: NewLocalFS(t.TempDir())}
+	replica := NewLocalFS(t.TempDir())
+
+	queue := NewMemoryReplicationQueue()
+	replicated := NewReplicatedFS(primary, []Replica{{Name: "dr", FS: replica}}, ReplicationOptions{Queue: queue, Interval: time.Hour})
+	defer replicated.Close()
+
+	for _, p := range []string{"logs/a.txt", "reports/b.txt"} {
+		if _, err := replica.Write(ctx, p, strings.NewReader(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := queue.Push(ReplicationTask{Replica: "dr", Path: "logs/nested/c.txt", Op: ReplicateWrite, CreatedAt: time.Now(), NextAttempt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.down = true
+	if _, err := replicated.ReadDir("logs"); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("expected the replica with a pending replication under the directory to be skipped, got %v", err)
+	}
+	if _, err := replicated.ReadDir(""); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("expected the replica with a pending replication to be skipped for the root, got %v", err)
+	}
+	if files, err := replicated.ReadDir("reports"); err != nil || len(files) != 1 {
+		t.Errorf("expected the listing to fall back to the replica, got %v: %v", files, err)
+	}
+}
+
+// blockingFS blocks its writes until release is closed.
+type blockingFS struct {
+	FilesystemRW
+	started chan struct{}
+	release chan struct{}
+	writes  atomic.Int32
+}
+
+func (t *blockingFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
+	if t.writes.Add(1) == 1 {
+		close(t.started)
+	}
+	<-t.release
+	return t.FilesystemRW.Write(ctx, path, data)
+}
+
+func TestReplicationDrainSerialized(t *testing.T) {
+	ctx := gocontext.TODO()
+	primary := NewLocalFS(t.TempDir())
+	replica := &blockingFS{FilesystemRW: NewLocalFS(t.TempDir()), started: make(chan struct{}), release: make(chan struct{})}
+
+	queue := NewMemoryReplicationQueue()
+	replicated := NewReplicatedFS(primary, []Replica{{Name: "dr", FS: replica}}, ReplicationOptions{Queue: queue, Interval: time.Hour})
+	defer replicated.Close()
+
+	if _, err := primary.Write(ctx, "a.txt", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Push(ReplicationTask{Replica: "dr", Path: "a.txt", Op: ReplicateWrite, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	drain := func() {
+		defer wg.Done()
+		if _, err := replicated.Drain(ctx); err != nil {
+			t.Error(err)
+		}
+	}
+	wg.Add(2)
+	go drain()
+	<-replica.started
+	go drain()
+
+	time.Sleep(50 * time.Millisecond)
+	close(replica.release)
+	wg.Wait()
+
+	if writes := replica.writes.Load(); writes != 1 {
+		t.Errorf("expected the replication to be applied once, got %d", writes)
+	}
+}
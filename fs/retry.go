@@ -0,0 +1,249 @@
+package fs
+
+import (
+	gocontext "context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// RetryAttempt describes a failed attempt of an operation that is about to be retried.
+type RetryAttempt struct {
+	// Op is the filesystem operation: Stat, ReadDir, Read, Write or Delete.
+	Op   string
+	Path string
+
+	// Attempt is the number of the failed attempt, starting at 1.
+	Attempt int
+	Err     error
+
+	// Delay is the time waited before the next attempt.
+	Delay time.Duration
+}
+
+// RetryOptions configures the retries of NewRetryFS. Zero values use the defaults.
+type RetryOptions struct {
+	// MaxAttempts is the number of times an operation is tried. Defaults to 4.
+	MaxAttempts int
+
+	// MaxElapsed is the budget of time an operation is retried for, counted from its first attempt.
+	// An attempt is not made if its delay would exceed the budget. Zero means no budget.
+	MaxElapsed time.Duration
+
+	// InitialBackoff is the delay before the first retry. Defaults to 200ms.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between two attempts. Defaults to 10s.
+	MaxBackoff time.Duration
+
+	// Multiplier is the factor the delay grows by after every attempt. Defaults to 2.
+	Multiplier float64
+
+	// Jitter is the fraction of the delay that is randomized, from 0 to 1. Defaults to 0.5.
+	Jitter float64
+
+	// Retryable decides whether an error is transient. Defaults to IsRetryable.
+	Retryable func(err error) bool
+
+	// OnRetry is called before every retry, e.g. to log it.
+	OnRetry func(attempt RetryAttempt)
+}
+
+func (t RetryOptions) withDefaults() RetryOptions {
+	if t.MaxAttempts <= 0 {
+		t.MaxAttempts = 4
+	}
+	if t.InitialBackoff <= 0 {
+		t.InitialBackoff = 200 * time.Millisecond
+	}
+	if t.MaxBackoff <= 0 {
+		t.MaxBackoff = 10 * time.Second
+	}
+	if t.Multiplier < 1 {
+		t.Multiplier = 2
+	}
+	if t.Jitter <= 0 || t.Jitter > 1 {
+		t.Jitter = 0.5
+	}
+	if t.Retryable == nil {
+		t.Retryable = IsRetryable
+	}
+	return t
+}
+
+// delay returns the backoff before the given retry, with its jittered fraction drawn at random.
+func (t RetryOptions) delay(retry int) time.Duration {
+	backoff := float64(t.InitialBackoff)
+	for range retry - 1 {
+		backoff *= t.Multiplier
+		if backoff >= float64(t.MaxBackoff) {
+			break
+		}
+	}
+	backoff = min(backoff, float64(t.MaxBackoff))
+
+	return time.Duration(backoff*(1-t.Jitter) + rand.Float64()*backoff*t.Jitter)
+}
+
+// IsRetryable reports whether err is a transient failure worth retrying:
+// network errors, dropped SFTP and SMB sessions, and throttling or server errors of S3 and GCS.
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, gocontext.Canceled), errors.Is(err, gocontext.DeadlineExceeded):
+		return false
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, ErrAlreadyExists), errors.Is(err, ErrPreconditionFailed),
+		errors.Is(err, os.ErrPermission), errors.Is(err, errors.ErrUnsupported):
+		return false
+	}
+
+	return isConnectionError(err) || isRetryableSFTP(err) || isRetryableSMB(err) || isRetryableS3(err) || isRetryableGCS(err)
+}
+
+// isConnectionError reports whether err is a network failure: a timeout, or a connection that was reset or closed.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE)
+}
+
+// retryFS implements FilesystemRW, retrying the idempotent operations of another filesystem
+// with exponential backoff and jitter.
+//
+// Stat, ReadDir, Read and Delete are always retried. Write is retried for the default overwrite mode
+// when the content can be replayed: it is seekable, or no byte of it was consumed by the failed attempt.
+// Conditional writes are not retried, as a lost response would turn into a spurious conflict.
+type retryFS struct {
+	FilesystemRW
+	opts RetryOptions
+}
+
+func NewRetryFS(fs FilesystemRW, opts RetryOptions) *retryFS {
+	return &retryFS{FilesystemRW: fs, opts: opts.withDefaults()}
+}
+
+// retry runs op until it succeeds, fails with an error that is not retryable, or runs out of budget.
+// canRetry, if set, is asked before every retry whether the operation can be repeated.
+func (t *retryFS) retry(ctx gocontext.Context, name, path string, op func() error, canRetry func() bool) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= t.opts.MaxAttempts || !t.opts.Retryable(err) {
+			return err
+		}
+
+		if canRetry != nil && !canRetry() {
+			return err
+		}
+
+		delay := t.opts.delay(attempt)
+		if t.opts.MaxElapsed > 0 && time.Since(start)+delay > t.opts.MaxElapsed {
+			return err
+		}
+
+		if t.opts.OnRetry != nil {
+			t.opts.OnRetry(RetryAttempt{Op: name, Path: path, Attempt: attempt, Err: err, Delay: delay})
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+func (t *retryFS) Stat(path string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := t.retry(gocontext.Background(), "Stat", path, func() (err error) {
+		info, err = t.FilesystemRW.Stat(path)
+		return err
+	}, nil)
+	return info, err
+}
+
+func (t *retryFS) ReadDir(name string) ([]FileInfo, error) {
+	var files []FileInfo
+	err := t.retry(gocontext.Background(), "ReadDir", name, func() (err error) {
+		files, err = t.FilesystemRW.ReadDir(name)
+		return err
+	}, nil)
+	return files, err
+}
+
+func (t *retryFS) ReadDirTruncated(name string) ([]FileInfo, bool, error) {
+	var files []FileInfo
+	var truncated bool
+	err := t.retry(gocontext.Background(), "ReadDir", name, func() (err error) {
+		files, truncated, err = readDir(t.FilesystemRW, name)
+		return err
+	}, nil)
+	return files, truncated, err
+}
+
+func (t *retryFS) Read(ctx gocontext.Context, path string) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := t.retry(ctx, "Read", path, func() (err error) {
+		reader, err = t.FilesystemRW.Read(ctx, path)
+		return err
+	}, nil)
+	return reader, err
+}
+
+func (t *retryFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
+	if mode := GetWriteOptions(ctx).Mode; mode != "" && mode != WriteOverwrite {
+		return t.FilesystemRW.Write(ctx, path, data)
+	}
+
+	replay, err := newReplayableReader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var info os.FileInfo
+	err = t.retry(ctx, "Write", path, func() (err error) {
+		info, err = t.FilesystemRW.Write(ctx, path, replay.reader)
+		return err
+	}, func() bool {
+		rewound, _ := replay.rewind()
+		return rewound
+	})
+	return info, err
+}
+
+func (t *retryFS) Delete(ctx gocontext.Context, path string) error {
+	attempts := 0
+	return t.retry(ctx, "Delete", path, func() error {
+		attempts++
+		err := t.FilesystemRW.Delete(ctx, path)
+		if attempts > 1 && errors.Is(err, os.ErrNotExist) {
+			// the failed attempt may have deleted it before its response was lost
+			return nil
+		}
+		return err
+	}, nil)
+}
+
+func (t *retryFS) SetMaxListItems(max int) {
+	setMaxListItems(t.FilesystemRW, max)
+}
+
+func (t *retryFS) SetServerSideEncryption(sse *ServerSideEncryption) {
+	setServerSideEncryption(t.FilesystemRW, sse)
+}
+
+func (t *retryFS) Health() SessionHealth {
+	return health(t.FilesystemRW)
+}
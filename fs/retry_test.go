@@ -0,0 +1,88 @@
+package fs
+
+import (
+	gocontext "context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyFS fails the first writes with a connection reset after consuming some of the content.
+type flakyFS struct {
+	FilesystemRW
+	failures int
+}
+
+func (t *flakyFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
+	if t.failures > 0 {
+		t.failures--
+		_, _ = io.CopyN(io.Discard, data, 2)
+		return nil, syscall.ECONNRESET
+	}
+	return t.FilesystemRW.Write(ctx, path, data)
+}
+
+func TestRetryFSWrite(t *testing.T) {
+	flaky := &flakyFS{FilesystemRW: NewLocalFS(t.TempDir()), failures: 2}
+
+	var attempts []RetryAttempt
+	retrying := NewRetryFS(flaky, RetryOptions{
+		InitialBackoff: time.Millisecond,
+		OnRetry:        func(attempt RetryAttempt) { attempts = append(attempts, attempt) },
+	})
+
+	if _, err := retrying.Write(gocontext.TODO(), "a.txt", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Errorf("expected 2 retries, got %d", len(attempts))
+	}
+
+	reader, err := retrying.Read(gocontext.TODO(), "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	content, _ := io.ReadAll(reader)
+	if string(content) != "content" {
+		t.Errorf("expected the content to be replayed, got %q", content)
+	}
+
+	// content that was partially consumed and cannot be rewound is not retried
+	flaky.failures = 1
+	_, err = retrying.Write(gocontext.TODO(), "b.txt", io.MultiReader(strings.NewReader("content")))
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("expected the write to fail, got %v", err)
+	}
+}
+
+func TestRetryFSForwardsOptionalInterfaces(t *testing.T) {
+	s3, requests := newFakeS3(t)
+	var wrapped FilesystemRW = NewRetryFS(s3, RetryOptions{})
+
+	limiter, ok := wrapped.(ListItemLimiter)
+	if !ok {
+		t.Fatal("expected the wrapper to forward SetMaxListItems")
+	}
+	limiter.SetMaxListItems(1)
+
+	if _, ok := wrapped.(ServerSideEncrypter); !ok {
+		t.Error("expected the wrapper to forward SetServerSideEncryption")
+	}
+
+	_, truncated, err := wrapped.(TruncatingLister).ReadDirTruncated(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("expected the truncation of the listing to be forwarded")
+	}
+	if query := requests()[0].Query; !strings.Contains(query, "max-keys=1") {
+		t.Errorf("expected the listing limit to reach the filesystem, got %s", query)
+	}
+}
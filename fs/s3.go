@@ -3,15 +3,20 @@ package fs
 import (
 	"bytes"
 	gocontext "context"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/bmatcuk/doublestar/v4"
 	awsUtil "github.com/flanksource/artifacts/clients/aws"
 	"github.com/flanksource/commons/utils"
@@ -20,7 +25,12 @@ import (
 	"github.com/samber/lo"
 )
 
-const s3ListObjectMaxKeys = 1000
+const (
+	s3ListObjectMaxKeys = 1000
+
+	// s3MultipartPartSize is the part size used to upload content of unknown length
+	s3MultipartPartSize = 8 * 1024 * 1024
+)
 
 // s3FS implements
 // - FilesystemRW for S3
@@ -29,6 +39,9 @@ type s3FS struct {
 	// maxObjects limits the total number of objects ReadDir can return.
 	maxObjects int
 
+	// encryption is the server-side encryption applied to writes, and its customer key to reads.
+	encryption *ServerSideEncryption
+
 	Client *s3.Client
 	Bucket string
 }
@@ -62,14 +75,32 @@ func (t *s3FS) SetMaxListItems(max int) {
 	t.maxObjects = max
 }
 
+func (t *s3FS) SetServerSideEncryption(sse *ServerSideEncryption) {
+	t.encryption = sse
+}
+
 func (t *s3FS) Close() error {
 	return nil // NOOP
 }
 
+// ReadDir lists the objects beneath the directory recursively, or the objects matching a glob pattern.
+// At most the number of objects set with SetMaxListItems are listed.
 func (t *s3FS) ReadDir(pattern string) ([]FileInfo, error) {
+	output, _, err := t.ReadDirTruncated(pattern)
+	return output, err
+}
+
+// ReadDirTruncated is ReadDir, also reporting whether objects were left out because of SetMaxListItems.
+func (t *s3FS) ReadDirTruncated(pattern string) ([]FileInfo, bool, error) {
 	prefix, glob := doublestar.SplitPattern(pattern)
-	if prefix == "." {
+	if !hasGlobMeta(pattern) {
+		// a directory: only the keys beneath it, not those that merely share its name as a prefix
+		prefix, glob = strings.TrimSuffix(pattern, "/"), ""
+	}
+	if prefix == "." || prefix == "" {
 		prefix = ""
+	} else {
+		prefix += "/"
 	}
 
 	req := &s3.ListObjectsV2Input{
@@ -87,13 +118,13 @@ func (t *s3FS) ReadDir(pattern string) ([]FileInfo, error) {
 	for {
 		resp, err := t.Client.ListObjectsV2(gocontext.TODO(), req)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
 		for _, obj := range resp.Contents {
 			if hasGlob {
 				if matched, err := doublestar.Match(pattern, *obj.Key); err != nil {
-					return nil, err
+					return nil, false, err
 				} else if !matched {
 					continue
 				}
@@ -109,21 +140,37 @@ func (t *s3FS) ReadDir(pattern string) ([]FileInfo, error) {
 
 		numObjectsFetched += int(*resp.KeyCount)
 		if numObjectsFetched >= t.maxObjects {
-			break
+			return output, true, nil
 		}
 
 		req.ContinuationToken = resp.NextContinuationToken
 	}
 
-	return output, nil
+	return output, false, nil
+}
+
+// hasGlobMeta reports whether the pattern has characters with a special meaning in a glob.
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[{\\")
 }
 
 func (t *s3FS) Stat(path string) (fs.FileInfo, error) {
-	headObject, err := t.Client.HeadObject(gocontext.TODO(), &s3.HeadObjectInput{
+	return t.stat(gocontext.TODO(), path, t.encryption)
+}
+
+func (t *s3FS) stat(ctx gocontext.Context, path string, sse *ServerSideEncryption) (fs.FileInfo, error) {
+	input := &s3.HeadObjectInput{
 		Bucket: aws.String(t.Bucket),
 		Key:    aws.String(path),
-	})
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = sse.customerKeyHeaders()
+
+	headObject, err := t.Client.HeadObject(ctx, input)
 	if err != nil {
+		var notFound *s3Types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, notExistError{err: err}
+		}
 		return nil, err
 	}
 
@@ -134,54 +181,243 @@ func (t *s3FS) Stat(path string) (fs.FileInfo, error) {
 			LastModified: headObject.LastModified,
 			ETag:         headObject.ETag,
 		},
+		SSEAlgorithm:         string(headObject.ServerSideEncryption),
+		SSEKMSKeyID:          lo.FromPtr(headObject.SSEKMSKeyId),
+		SSECustomerAlgorithm: lo.FromPtr(headObject.SSECustomerAlgorithm),
+		Metadata:             headObject.Metadata,
 	}
 
 	return fileInfo, nil
 }
 
 func (t *s3FS) Read(ctx gocontext.Context, key string) (io.ReadCloser, error) {
-	results, err := t.Client.GetObject(ctx, &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(t.Bucket),
 		Key:    aws.String(key),
-	})
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = t.encryption.customerKeyHeaders()
+
+	results, err := t.Client.GetObject(ctx, input)
 	if err != nil {
+		var noSuchKey *s3Types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, notExistError{err: err}
+		}
 		return nil, err
 	}
 
-	return results.Body, nil
+	return readTransfer(ctx, results.Body, func() int64 { return lo.FromPtrOr(results.ContentLength, -1) }), nil
 }
 
 func (t *s3FS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
+	opts := GetWriteOptions(ctx)
+	if opts.Mode == WriteRenameWithSuffix {
+		return writeWithSuffix(ctx, t, path, data)
+	}
+
+	ifMatch, ifNoneMatch, err := s3Conditions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sse, err := writeEncryption(t.encryption, opts)
+	if err != nil {
+		return nil, err
+	}
+	checksumAlgorithm := s3Types.ChecksumAlgorithm(strings.ToUpper(opts.ChecksumAlgorithm))
+	if !slices.Contains(checksumAlgorithm.Values(), checksumAlgorithm) {
+		checksumAlgorithm = ""
+	}
+
 	// Try to determine content length from the reader using type-based heuristics
 	contentLength := getContentLength(data)
 
 	var body io.Reader
 	if contentLength >= 0 {
 		// Content length is known, use the reader directly
-		body = data
+		body = writeTransfer(ctx, data)
 	} else {
-		// Content length unknown, need to buffer to determine size
+		// Content length unknown: content that fits in a single part is buffered,
+		// larger content is uploaded in parts.
 		// This is required because S3 PutObject requires Content-Length header
-		content, err := io.ReadAll(data)
-		if err != nil {
+		part := make([]byte, s3MultipartPartSize)
+		n, err := io.ReadFull(data, part)
+		if err == nil {
+			if err := t.multipartUpload(ctx, path, io.MultiReader(bytes.NewReader(part), data), sse, checksumAlgorithm, opts); err != nil {
+				return nil, s3ConditionError(opts.Mode, err)
+			}
+			return t.stat(ctx, path, sse)
+		} else if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
 			return nil, err
 		}
-		contentLength = int64(len(content))
-		body = bytes.NewReader(content)
+
+		contentLength = int64(n)
+		body = writeParts(ctx, contentLength)(part[:n])
 	}
 
-	_, err := t.Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:        aws.String(t.Bucket),
-		Key:           aws.String(path),
-		Body:          body,
-		ContentLength: &contentLength,
-	})
+	input := &s3.PutObjectInput{
+		Bucket:            aws.String(t.Bucket),
+		Key:               aws.String(path),
+		Body:              body,
+		ContentLength:     &contentLength,
+		ChecksumAlgorithm: checksumAlgorithm,
+		Metadata:          opts.Metadata,
+		IfMatch:           ifMatch,
+		IfNoneMatch:       ifNoneMatch,
+	}
+	if sse != nil {
+		input.ServerSideEncryption = s3Types.ServerSideEncryption(sse.s3Algorithm())
+		input.SSEKMSKeyId = lo.EmptyableToPtr(sse.KMSKeyID)
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = sse.customerKeyHeaders()
+
+	if _, err := t.Client.PutObject(ctx, input); err != nil {
+		return nil, s3ConditionError(opts.Mode, err)
+	}
+
+	return t.stat(ctx, path, sse)
+}
 
+// multipartUpload uploads content of unknown length in parts of s3MultipartPartSize.
+// The upload is aborted if any part fails.
+func (t *s3FS) multipartUpload(ctx gocontext.Context, path string, data io.Reader, sse *ServerSideEncryption, checksumAlgorithm s3Types.ChecksumAlgorithm, opts WriteOptions) error {
+	ifMatch, ifNoneMatch, err := s3Conditions(opts)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(t.Bucket),
+		Key:               aws.String(path),
+		ChecksumAlgorithm: checksumAlgorithm,
+		Metadata:          opts.Metadata,
+	}
+	if sse != nil {
+		createInput.ServerSideEncryption = s3Types.ServerSideEncryption(sse.s3Algorithm())
+		createInput.SSEKMSKeyId = lo.EmptyableToPtr(sse.KMSKeyID)
+	}
+	createInput.SSECustomerAlgorithm, createInput.SSECustomerKey, createInput.SSECustomerKeyMD5 = sse.customerKeyHeaders()
+
+	upload, err := t.Client.CreateMultipartUpload(ctx, createInput)
+	if err != nil {
+		return err
+	}
+
+	abort := func(cause error) error {
+		_, err := t.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(t.Bucket),
+			Key:      aws.String(path),
+			UploadId: upload.UploadId,
+		})
+		if err != nil {
+			return errors.Join(cause, fmt.Errorf("error aborting multipart upload: %w", err))
+		}
+		return cause
+	}
+
+	var completed []s3Types.CompletedPart
+	send := writeParts(ctx, -1)
+	part := make([]byte, s3MultipartPartSize)
+	for partNumber := int32(1); ; partNumber++ {
+		n, readErr := io.ReadFull(data, part)
+		if readErr != nil && !errors.Is(readErr, io.EOF) && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return abort(readErr)
+		}
+
+		if n == 0 && partNumber > 1 {
+			break
+		}
+
+		partInput := &s3.UploadPartInput{
+			Bucket:            aws.String(t.Bucket),
+			Key:               aws.String(path),
+			UploadId:          upload.UploadId,
+			PartNumber:        aws.Int32(partNumber),
+			Body:              send(part[:n]),
+			ContentLength:     aws.Int64(int64(n)),
+			ChecksumAlgorithm: checksumAlgorithm,
+		}
+		partInput.SSECustomerAlgorithm, partInput.SSECustomerKey, partInput.SSECustomerKeyMD5 = sse.customerKeyHeaders()
+
+		uploaded, err := t.Client.UploadPart(ctx, partInput)
+		if err != nil {
+			return abort(err)
+		}
+		completed = append(completed, s3Types.CompletedPart{
+			ETag:              uploaded.ETag,
+			PartNumber:        aws.Int32(partNumber),
+			ChecksumCRC32:     uploaded.ChecksumCRC32,
+			ChecksumCRC32C:    uploaded.ChecksumCRC32C,
+			ChecksumCRC64NVME: uploaded.ChecksumCRC64NVME,
+			ChecksumSHA1:      uploaded.ChecksumSHA1,
+			ChecksumSHA256:    uploaded.ChecksumSHA256,
+		})
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	completeInput := &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(t.Bucket),
+		Key:             aws.String(path),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3Types.CompletedMultipartUpload{Parts: completed},
+		IfMatch:         ifMatch,
+		IfNoneMatch:     ifNoneMatch,
+	}
+	completeInput.SSECustomerAlgorithm, completeInput.SSECustomerKey, completeInput.SSECustomerKeyMD5 = sse.customerKeyHeaders()
+
+	if _, err := t.Client.CompleteMultipartUpload(ctx, completeInput); err != nil {
+		return abort(err)
+	}
+
+	return nil
+}
+
+// s3Conditions returns the If-Match and If-None-Match headers of a write.
+func s3Conditions(opts WriteOptions) (ifMatch, ifNoneMatch *string, err error) {
+	switch opts.Mode {
+	case "", WriteOverwrite:
+		return nil, nil, nil
+	case WriteFailIfExists:
+		return nil, aws.String("*"), nil
+	case WriteIfMatch:
+		if opts.IfMatch == "" {
+			return nil, nil, errors.New("write mode if-match requires an ETag")
+		}
+		return aws.String(opts.IfMatch), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: write mode %s", errors.ErrUnsupported, opts.Mode)
 	}
+}
 
-	return t.Stat(path)
+// s3ConditionError maps the failure of a conditional write to ErrAlreadyExists or ErrPreconditionFailed.
+// A conflicting concurrent conditional write is reported the same way.
+func s3ConditionError(mode WriteMode, err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return conditionFailed(mode, err)
+		}
+	}
+
+	return err
+}
+
+// Delete fails with os.ErrNotExist when there is no object at path, like the other filesystems,
+// although S3 deletes a missing key without an error.
+func (t *s3FS) Delete(ctx gocontext.Context, path string) error {
+	if _, err := t.stat(ctx, path, t.encryption); errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	_, err := t.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(t.Bucket),
+		Key:    aws.String(path),
+	})
+	return err
 }
 
 // getContentLength attempts to determine content length from the reader using heuristics
@@ -225,3 +461,36 @@ func getContentLength(r io.Reader) int64 {
 	// Unknown length
 	return -1
 }
+
+// isRetryableS3 reports whether err is an S3 throttling or server error.
+func isRetryableS3(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "ServiceUnavailable", "InternalError", "RequestTimeout", "Throttling", "ThrottlingException":
+			return true
+		}
+	}
+
+	var responseErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &responseErr) {
+		code := responseErr.HTTPStatusCode()
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+
+	return false
+}
+
+// isAuthErrorS3 reports whether S3 rejected the credentials, rather than denied access with valid ones.
+func isAuthErrorS3(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken", "TokenRefreshRequired":
+			return true
+		}
+	}
+
+	var responseErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusUnauthorized
+}
@@ -0,0 +1,189 @@
+package fs
+
+import (
+	gocontext "context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Request is a request received by the fake S3 server.
+type s3Request struct {
+	Method string
+	Query  string
+	Header http.Header
+}
+
+// newFakeS3 returns a filesystem on a server answering just enough of the S3 API for uploads, listings and deletes,
+// and the requests the server received. Keys starting with "missing" do not exist.
+func newFakeS3(t *testing.T) (*s3FS, func() []s3Request) {
+	var mu sync.Mutex
+	var requests []s3Request
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+
+		mu.Lock()
+		requests = append(requests, s3Request{Method: r.Method, Query: r.URL.RawQuery, Header: r.Header.Clone()})
+		mu.Unlock()
+
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			_, _ = io.WriteString(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPost && query.Has("uploadId"):
+			_, _ = io.WriteString(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`)
+		case r.Method == http.MethodGet && query.Get("list-type") == "2":
+			// a page of one object, with more to follow
+			_, _ = io.WriteString(w, `<ListBucketResult><Name>bucket</Name><KeyCount>1</KeyCount><IsTruncated>true</IsTruncated><NextContinuationToken>next</NextContinuationToken><Contents><Key>a.txt</Key><Size>1</Size></Contents></ListBucketResult>`)
+		case r.Method == http.MethodHead && strings.HasPrefix(path.Base(r.URL.Path), "missing"):
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPut, r.Method == http.MethodHead:
+			w.Header().Set("ETag", `"etag"`)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(gocontext.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+
+	return &s3FS{Client: client, Bucket: "bucket"}, func() []s3Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func TestS3ServerSideEncryption(t *testing.T) {
+	// content of unknown length larger than a part is uploaded in parts
+	content := func() io.Reader {
+		return io.MultiReader(strings.NewReader(strings.Repeat("a", s3MultipartPartSize)), strings.NewReader("more"))
+	}
+
+	t.Run("KMS key without algorithm", func(t *testing.T) {
+		s3, requests := newFakeS3(t)
+		s3.SetServerSideEncryption(&ServerSideEncryption{KMSKeyID: "key"})
+
+		if _, err := s3.Write(gocontext.TODO(), "multipart.txt", content()); err != nil {
+			t.Fatal(err)
+		}
+
+		create := requests()[0]
+		if !strings.Contains(create.Query, "uploads") {
+			t.Fatalf("expected a multipart upload, got %s %s", create.Method, create.Query)
+		}
+		if algorithm := create.Header.Get("x-amz-server-side-encryption"); algorithm != "aws:kms" {
+			t.Errorf("expected the algorithm to default to aws:kms, got %q", algorithm)
+		}
+		if keyID := create.Header.Get("x-amz-server-side-encryption-aws-kms-key-id"); keyID != "key" {
+			t.Errorf("expected the KMS key to be sent, got %q", keyID)
+		}
+	})
+
+	t.Run("customer key", func(t *testing.T) {
+		s3, requests := newFakeS3(t)
+		s3.SetServerSideEncryption(&ServerSideEncryption{CustomerKey: make([]byte, 32)})
+
+		if _, err := s3.Write(gocontext.TODO(), "multipart.txt", content()); err != nil {
+			t.Fatal(err)
+		}
+
+		sent := requests()
+		if len(sent) != 5 {
+			t.Fatalf("expected create, 2 parts, complete and head requests, got %d requests", len(sent))
+		}
+		for _, r := range sent {
+			if r.Header.Get("x-amz-server-side-encryption-customer-key") == "" {
+				t.Errorf("expected the customer key with %s %s", r.Method, r.Query)
+			}
+		}
+	})
+
+	t.Run("customer key override", func(t *testing.T) {
+		s3, requests := newFakeS3(t)
+		ctx := WithWriteOptions(gocontext.TODO(), WriteOptions{ServerSideEncryption: &ServerSideEncryption{CustomerKey: make([]byte, 32)}})
+
+		if _, err := s3.Write(ctx, "multipart.txt", content()); !errors.Is(err, ErrCustomerKeyOverride) {
+			t.Errorf("expected ErrCustomerKeyOverride, got %v", err)
+		}
+		if len(requests()) != 0 {
+			t.Errorf("expected nothing to be uploaded, got %d requests", len(requests()))
+		}
+	})
+}
+
+func TestS3ListOneItem(t *testing.T) {
+	s3, requests := newFakeS3(t)
+	s3.SetMaxListItems(1)
+
+	files, truncated, err := s3.ReadDirTruncated(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !truncated {
+		t.Errorf("expected a truncated listing of 1 object, got %d objects (truncated: %t)", len(files), truncated)
+	}
+
+	if len(requests()) != 1 {
+		t.Fatalf("expected a single list request, got %d", len(requests()))
+	}
+	if query := requests()[0].Query; !strings.Contains(query, "max-keys=1") {
+		t.Errorf("expected the request to ask for 1 key, got %s", query)
+	}
+}
+
+func TestS3WriteProgress(t *testing.T) {
+	s3, requests := newFakeS3(t)
+	content := io.MultiReader(strings.NewReader(strings.Repeat("a", s3MultipartPartSize)), strings.NewReader("more"))
+
+	var sent int64
+	ctx := WithWriteOptions(gocontext.TODO(), WriteOptions{
+		Progress: func(n, _ int64) {
+			if sent == 0 && len(requests()) == 0 {
+				t.Error("expected no progress before the upload started")
+			}
+			sent = n
+		},
+	})
+	if _, err := s3.Write(ctx, "multipart.txt", content); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != s3MultipartPartSize+4 {
+		t.Errorf("expected progress of %d bytes, got %d", s3MultipartPartSize+4, sent)
+	}
+}
+
+func TestS3DeleteMissing(t *testing.T) {
+	s3, requests := newFakeS3(t)
+
+	if err := s3.Delete(gocontext.TODO(), "missing.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist for a missing key, got %v", err)
+	}
+	if sent := requests(); len(sent) != 1 || sent[0].Method != http.MethodHead {
+		t.Errorf("expected nothing to be deleted, got %+v", sent)
+	}
+
+	if err := s3.Delete(gocontext.TODO(), "a.txt"); err != nil {
+		t.Errorf("expected the object to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package fs
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultKeepaliveInterval is how often SFTP and SMB sessions are checked when idle.
+const DefaultKeepaliveInterval = 30 * time.Second
+
+// SessionState is the state of the session of a filesystem backed by a long-lived connection.
+type SessionState string
+
+const (
+	SessionConnected    SessionState = "connected"
+	SessionDisconnected SessionState = "disconnected"
+	SessionClosed       SessionState = "closed"
+)
+
+var errSessionClosed = errors.New("session is closed")
+
+// SessionHealth reports the state of a filesystem's session.
+type SessionHealth struct {
+	State SessionState
+
+	// LastError is the error the session last broke, or failed to reconnect, with.
+	LastError error
+
+	// ConnectedAt is when the current session was established.
+	ConnectedAt time.Time
+
+	// Reconnects is the number of times the session was redialed.
+	Reconnects int
+}
+
+// HealthReporter is implemented by filesystems that keep a session to their server, i.e. SFTP and SMB.
+// Wrappers of a filesystem implement it too: the State of a filesystem without a session is empty.
+type HealthReporter interface {
+	Health() SessionHealth
+}
+
+type sessionConn interface {
+	comparable
+	Close() error
+}
+
+// session keeps a connection alive: it is redialed with the original credentials when it breaks,
+// and checked with a keepalive while idle.
+type session[T sessionConn] struct {
+	mu     sync.Mutex
+	conn   T
+	health SessionHealth
+
+	// inUse is the number of operations holding the connection. The keepalive only checks an idle connection.
+	inUse int
+
+	dial func() (T, error)
+
+	// ping checks that the connection is still alive
+	ping func(T) error
+
+	// isBroken reports whether an error means the connection is lost
+	isBroken func(error) bool
+
+	stopKeepalive chan struct{}
+}
+
+func newSession[T sessionConn](dial func() (T, error), ping func(T) error, isBroken func(error) bool) (*session[T], error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session[T]{
+		conn:     conn,
+		health:   SessionHealth{State: SessionConnected, ConnectedAt: time.Now()},
+		dial:     dial,
+		ping:     ping,
+		isBroken: isBroken,
+	}
+	s.SetKeepaliveInterval(DefaultKeepaliveInterval)
+	return s, nil
+}
+
+// idempotent is the retry condition of operations that can be repeated on a new connection.
+func idempotent() bool {
+	return true
+}
+
+// get returns the current connection, redialing it if it was lost.
+func (s *session[T]) get() (T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connect()
+}
+
+// acquire returns the current connection like get, holding it until release is called.
+func (s *session[T]) acquire() (conn T, release func(), err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if conn, err = s.connect(); err != nil {
+		return conn, nil, err
+	}
+
+	s.inUse++
+	return conn, sync.OnceFunc(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.inUse--
+	}), nil
+}
+
+// connect returns the current connection, redialing it if it was lost. s.mu must be held.
+func (s *session[T]) connect() (T, error) {
+	var zero T
+	switch s.health.State {
+	case SessionClosed:
+		return zero, errSessionClosed
+	case SessionConnected:
+		return s.conn, nil
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		s.health.LastError = err
+		return zero, err
+	}
+
+	s.conn = conn
+	s.health.State = SessionConnected
+	s.health.ConnectedAt = time.Now()
+	s.health.Reconnects++
+	return conn, nil
+}
+
+// invalidate marks conn as lost, unless the session has moved on to another connection already.
+// With idleOnly, a connection held by an operation is left alone: the operation finds out itself.
+func (s *session[T]) invalidate(conn T, cause error, idleOnly bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.health.State != SessionConnected || s.conn != conn || (idleOnly && s.inUse > 0) {
+		return
+	}
+
+	_ = conn.Close()
+	var zero T
+	s.conn = zero
+	s.health.State = SessionDisconnected
+	s.health.LastError = cause
+}
+
+// do runs op with the current connection. If the connection turns out to be lost, op is run once more
+// on a new connection, provided retry allows it. Operations that are not idempotent pass a nil retry:
+// a lost connection does not tell whether they took effect.
+func (s *session[T]) do(op func(T) error, retry func() bool) error {
+	release, err := s.hold(op, retry)
+	if err != nil {
+		return err
+	}
+
+	release()
+	return nil
+}
+
+// hold is do for operations that keep using the connection once op returns, e.g. an opened file.
+// The connection is held until release is called.
+func (s *session[T]) hold(op func(T) error, retry func() bool) (release func(), err error) {
+	conn, release, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = op(conn); err == nil {
+		return release, nil
+	}
+	release()
+
+	if !s.isBroken(err) {
+		return nil, err
+	}
+
+	s.invalidate(conn, err, false)
+	if retry == nil || !retry() {
+		return nil, err
+	}
+
+	if conn, release, err = s.acquire(); err != nil {
+		return nil, err
+	}
+	if err = op(conn); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// SetKeepaliveInterval changes how often the session is checked. Zero disables the keepalive.
+func (s *session[T]) SetKeepaliveInterval(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopKeepalive != nil {
+		close(s.stopKeepalive)
+		s.stopKeepalive = nil
+	}
+
+	if interval <= 0 || s.health.State == SessionClosed {
+		return
+	}
+
+	s.stopKeepalive = make(chan struct{})
+	go s.keepalive(interval, s.stopKeepalive)
+}
+
+func (s *session[T]) keepalive(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+// check pings an idle connection, redialing it right away if it is lost,
+// so that the next call does not wait for it. A connection in use is not checked.
+func (s *session[T]) check() {
+	s.mu.Lock()
+	busy := s.inUse > 0
+	s.mu.Unlock()
+	if busy {
+		return
+	}
+
+	conn, release, err := s.acquire()
+	if err != nil {
+		return
+	}
+
+	err = s.ping(conn)
+	release()
+	if err != nil {
+		s.invalidate(conn, err, true)
+		_, _ = s.get()
+	}
+}
+
+// Health returns the state of the session.
+func (s *session[T]) Health() SessionHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.health
+}
+
+func (s *session[T]) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopKeepalive != nil {
+		close(s.stopKeepalive)
+		s.stopKeepalive = nil
+	}
+
+	if s.health.State == SessionClosed {
+		return nil
+	}
+
+	var err error
+	if s.health.State == SessionConnected {
+		err = s.conn.Close()
+	}
+	s.health.State = SessionClosed
+	return err
+}
@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+type fakeConn struct {
+	id     int
+	closed bool
+}
+
+func (t *fakeConn) Close() error {
+	t.closed = true
+	return nil
+}
+
+func TestSessionReconnect(t *testing.T) {
+	dials := 0
+	s, err := newSession(
+		func() (*fakeConn, error) {
+			dials++
+			return &fakeConn{id: dials}, nil
+		},
+		func(*fakeConn) error { return nil },
+		isConnectionError,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var used []int
+	err = s.do(func(conn *fakeConn) error {
+		used = append(used, conn.id)
+		if conn.id == 1 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	}, idempotent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(used) != 2 || used[1] != 2 {
+		t.Errorf("expected the operation to be repeated on a new connection, got %v", used)
+	}
+
+	health := s.Health()
+	if health.State != SessionConnected || health.Reconnects != 1 {
+		t.Errorf("expected a connected session after 1 reconnect, got %+v", health)
+	}
+}
+
+func TestSessionNotIdempotent(t *testing.T) {
+	dials := 0
+	s, err := newSession(
+		func() (*fakeConn, error) {
+			dials++
+			return &fakeConn{id: dials}, nil
+		},
+		func(*fakeConn) error { return nil },
+		isConnectionError,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	attempts := 0
+	err = s.do(func(conn *fakeConn) error {
+		attempts++
+		return syscall.ECONNRESET
+	}, nil)
+	if !errors.Is(err, syscall.ECONNRESET) || attempts != 1 {
+		t.Errorf("expected a single attempt failing with the lost connection, got %d attempts: %v", attempts, err)
+	}
+
+	if health := s.Health(); health.State != SessionDisconnected {
+		t.Errorf("expected the session to be disconnected, got %+v", health)
+	}
+}
+
+func TestSessionKeepaliveInFlight(t *testing.T) {
+	pings := 0
+	s, err := newSession(
+		func() (*fakeConn, error) { return &fakeConn{}, nil },
+		func(*fakeConn) error {
+			pings++
+			return syscall.ETIMEDOUT
+		},
+		isConnectionError,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetKeepaliveInterval(0)
+	defer s.Close()
+
+	conn, release, err := s.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.check()
+	if pings != 0 || conn.closed {
+		t.Errorf("expected a connection in use not to be checked, got %d pings, closed=%v", pings, conn.closed)
+	}
+
+	release()
+	s.check()
+	if pings != 1 || !conn.closed {
+		t.Errorf("expected an idle connection to be checked and replaced, got %d pings, closed=%v", pings, conn.closed)
+	}
+	if health := s.Health(); health.State != SessionConnected || health.Reconnects != 1 {
+		t.Errorf("expected the session to be redialed, got %+v", health)
+	}
+}
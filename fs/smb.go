@@ -2,6 +2,7 @@ package fs
 
 import (
 	gocontext "context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -13,10 +14,15 @@ import (
 	"github.com/bmatcuk/doublestar/v4"
 	"github.com/flanksource/artifacts/clients/smb"
 	"github.com/flanksource/duty/types"
+	"github.com/hirochachacha/go-smb2"
 )
 
+// smbFS implements FilesystemRW over an SMB share.
+//
+// A dropped connection or expired session is redialed with the original credentials, and an idle session
+// is kept alive by periodically checking the share, see Health and SetKeepaliveInterval.
 type smbFS struct {
-	*smb.SMBSession
+	*session[*smb.SMBSession]
 }
 
 type SMBFileInfo struct {
@@ -33,38 +39,135 @@ func NewSMBFS(server string, port, share string, auth types.Authentication) (*sm
 		port = "445"
 	}
 
-	session, err := smb.SMBConnect(server, port, share, auth)
+	session, err := newSession(
+		func() (*smb.SMBSession, error) { return smb.SMBConnect(server, port, share, auth) },
+		func(conn *smb.SMBSession) error {
+			_, err := conn.Stat(".")
+			return err
+		},
+		func(err error) bool { return isRetryableSMB(err) || isConnectionError(err) },
+	)
 	if err != nil {
 		return nil, err
 	}
 
-	return &smbFS{SMBSession: session}, nil
+	return &smbFS{session: session}, nil
+}
+
+func (s *smbFS) Stat(name string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := s.do(func(conn *smb.SMBSession) (err error) {
+		info, err = conn.Stat(name)
+		return err
+	}, idempotent)
+	return info, err
 }
 
 func (s *smbFS) Read(ctx gocontext.Context, path string) (io.ReadCloser, error) {
-	return s.Open(path)
+	var file *smb2.File
+	release, err := s.hold(func(conn *smb.SMBSession) (err error) {
+		file, err = conn.Open(path)
+		return err
+	}, idempotent)
+	if err != nil {
+		return nil, err
+	}
+
+	held := &smbFile{File: file, release: release}
+	return readTransfer(ctx, held, fileSize(file)), nil
+}
+
+// smbFile is a file being read, which holds the session until it is closed.
+type smbFile struct {
+	*smb2.File
+	release func()
+}
+
+func (f *smbFile) Close() error {
+	defer f.release()
+	return f.File.Close()
+}
+
+// SMBSession returns the SMB session of the current connection, redialing it if it was lost.
+// The session is not held: it is closed when the connection is redialed or closed.
+func (s *smbFS) SMBSession() (*smb.SMBSession, error) {
+	return s.get()
 }
 
 func (s *smbFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
-	f, err := s.Create(path)
+	opts := GetWriteOptions(ctx)
+	if opts.Mode == WriteRenameWithSuffix {
+		return writeWithSuffix(ctx, s, path, data)
+	}
+	data = writeTransfer(ctx, data)
+
+	flags, err := openFlags(opts.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	replay, err := newReplayableReader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var info os.FileInfo
+	err = s.do(func(conn *smb.SMBSession) (err error) {
+		info, err = s.write(conn, path, replay.reader, opts.Mode, flags)
+		return err
+	}, func() bool {
+		// a create that was lost with the connection would fail again as a spurious conflict
+		if opts.Mode == WriteFailIfExists {
+			return false
+		}
+		rewound, _ := replay.rewind()
+		return rewound
+	})
+	return info, err
+}
+
+func (s *smbFS) write(conn *smb.SMBSession, path string, data io.Reader, mode WriteMode, flags int) (os.FileInfo, error) {
+	f, err := conn.OpenFile(path, flags, 0666)
 	if err != nil {
+		if mode == WriteFailIfExists {
+			if _, statErr := conn.Stat(path); statErr == nil {
+				return nil, conditionFailed(mode, err)
+			}
+		}
 		return nil, err
 	}
+	defer func() { _ = f.Close() }()
 
 	_, err = io.Copy(f, data)
 	if err != nil {
+		if mode == WriteFailIfExists {
+			// the file was created by this write
+			_ = f.Close()
+			_ = conn.Remove(path)
+		}
 		return nil, fmt.Errorf("error writing file: %w", err)
 	}
 
 	return f.Stat()
 }
 
+func (s *smbFS) Delete(ctx gocontext.Context, path string) error {
+	// a lost connection does not tell whether the file was removed, so it is not removed again
+	return s.do(func(conn *smb.SMBSession) error {
+		return conn.Remove(path)
+	}, nil)
+}
+
 func (t *smbFS) ReadDir(name string) ([]FileInfo, error) {
 	if strings.Contains(name, "*") {
 		return t.ReadDirGlob(name)
 	}
 
-	fileInfos, err := t.SMBSession.ReadDir(name)
+	var fileInfos []os.FileInfo
+	err := t.do(func(conn *smb.SMBSession) (err error) {
+		fileInfos, err = conn.ReadDir(name)
+		return err
+	}, idempotent)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +182,12 @@ func (t *smbFS) ReadDir(name string) ([]FileInfo, error) {
 
 func (t *smbFS) ReadDirGlob(name string) ([]FileInfo, error) {
 	base, pattern := doublestar.SplitPattern(name)
-	matches, err := doublestar.Glob(t.DirFS(base), pattern)
+
+	var matches []string
+	err := t.do(func(conn *smb.SMBSession) (err error) {
+		matches, err = doublestar.Glob(conn.DirFS(base), pattern)
+		return err
+	}, idempotent)
 	if err != nil {
 		return nil, fmt.Errorf("error globbing pattern %q: %w", pattern, err)
 	}
@@ -97,3 +205,37 @@ func (t *smbFS) ReadDirGlob(name string) ([]FileInfo, error) {
 
 	return output, nil
 }
+
+// NTSTATUS codes of SMB sessions that were dropped by the server
+const (
+	smbStatusNetworkNameDeleted     = 0xC00000C9
+	smbStatusUserSessionDeleted     = 0xC0000203
+	smbStatusConnectionDisconnected = 0xC000020C
+	smbStatusNetworkSessionExpired  = 0xC000035C
+)
+
+// isRetryableSMB reports whether err is caused by a dropped SMB connection or session.
+func isRetryableSMB(err error) bool {
+	var transportErr *smb2.TransportError
+	if errors.As(err, &transportErr) {
+		return true
+	}
+
+	var responseErr *smb2.ResponseError
+	if errors.As(err, &responseErr) {
+		switch responseErr.Code {
+		case smbStatusNetworkNameDeleted, smbStatusUserSessionDeleted, smbStatusConnectionDisconnected, smbStatusNetworkSessionExpired:
+			return true
+		}
+	}
+
+	return false
+}
+
+const smbStatusLogonFailure = 0xC000006D
+
+// isAuthErrorSMB reports whether the SMB session setup failed because the credentials were rejected.
+func isAuthErrorSMB(err error) bool {
+	var responseErr *smb2.ResponseError
+	return errors.As(err, &responseErr) && responseErr.Code == smbStatusLogonFailure
+}
@@ -2,6 +2,7 @@ package fs
 
 import (
 	gocontext "context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -13,8 +14,12 @@ import (
 	"github.com/pkg/sftp"
 )
 
+// sshFS implements FilesystemRW over SFTP.
+//
+// A lost connection is redialed with the original credentials, and an idle connection
+// is kept alive with SSH keepalive requests, see Health and SetKeepaliveInterval.
 type sshFS struct {
-	*sftp.Client
+	*session[*sftpClient.Client]
 	wd string
 }
 
@@ -28,28 +33,51 @@ func (t *sshFileInfo) FullPath() string {
 }
 
 func NewSSHFS(host, user, password string) (*sshFS, error) {
-	sftpClient, err := sftpClient.SSHConnect(host, user, password)
+	session, err := newSession(
+		func() (*sftpClient.Client, error) { return sftpClient.Connect(host, user, password) },
+		func(client *sftpClient.Client) error { return client.Keepalive() },
+		func(err error) bool { return isRetryableSFTP(err) || isConnectionError(err) },
+	)
 	if err != nil {
 		return nil, err
 	}
 
-	wd, err := sftpClient.Getwd()
+	client, err := session.get()
 	if err != nil {
+		return nil, err
+	}
+
+	wd, err := client.Getwd()
+	if err != nil {
+		_ = session.Close()
 		return nil, fmt.Errorf("failed to get working directory: %w", err)
 	}
 
 	return &sshFS{
-		wd:     wd,
-		Client: sftpClient,
+		wd:      wd,
+		session: session,
 	}, nil
 }
 
+func (t *sshFS) Stat(name string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := t.do(func(client *sftpClient.Client) (err error) {
+		info, err = client.Stat(name)
+		return err
+	}, idempotent)
+	return info, err
+}
+
 func (t *sshFS) ReadDir(name string) ([]FileInfo, error) {
 	if strings.Contains(name, "*") {
 		return t.ReadDirGlob(name)
 	}
 
-	files, err := t.Client.ReadDir(name)
+	var files []os.FileInfo
+	err := t.do(func(client *sftpClient.Client) (err error) {
+		files, err = client.ReadDir(name)
+		return err
+	}, idempotent)
 	if err != nil {
 		return nil, err
 	}
@@ -69,7 +97,11 @@ func (t *sshFS) ReadDir(name string) ([]FileInfo, error) {
 
 func (t *sshFS) ReadDirGlob(name string) ([]FileInfo, error) {
 	// TODO: This doesn't fully support doublestar
-	entries, err := t.Glob(name)
+	var entries []string
+	err := t.do(func(client *sftpClient.Client) (err error) {
+		entries, err = client.Glob(name)
+		return err
+	}, idempotent)
 	if err != nil {
 		return nil, err
 	}
@@ -88,26 +120,118 @@ func (t *sshFS) ReadDirGlob(name string) ([]FileInfo, error) {
 }
 
 func (s *sshFS) Read(ctx gocontext.Context, path string) (io.ReadCloser, error) {
-	return s.Open(path)
+	var file *sftp.File
+	release, err := s.hold(func(client *sftpClient.Client) (err error) {
+		file, err = client.Open(path)
+		return err
+	}, idempotent)
+	if err != nil {
+		return nil, err
+	}
+
+	held := &sftpFile{File: file, release: release}
+	return readTransfer(ctx, held, fileSize(file)), nil
+}
+
+// sftpFile is a file being read, which holds the session until it is closed.
+type sftpFile struct {
+	*sftp.File
+	release func()
+}
+
+func (f *sftpFile) Close() error {
+	defer f.release()
+	return f.File.Close()
+}
+
+// Client returns the SFTP client of the current session, redialing it if it was lost.
+// The client is not held: it is closed when the session is redialed or closed.
+func (t *sshFS) Client() (*sftp.Client, error) {
+	client, err := t.get()
+	if err != nil {
+		return nil, err
+	}
+	return client.Client, nil
 }
 
 func (s *sshFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
+	opts := GetWriteOptions(ctx)
+	if opts.Mode == WriteRenameWithSuffix {
+		return writeWithSuffix(ctx, s, path, data)
+	}
+	data = writeTransfer(ctx, data)
+
+	flags, err := openFlags(opts.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	replay, err := newReplayableReader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var info os.FileInfo
+	err = s.do(func(client *sftpClient.Client) (err error) {
+		info, err = s.write(client, path, replay.reader, opts.Mode, flags)
+		return err
+	}, func() bool {
+		// a create that was lost with the connection would fail again as a spurious conflict
+		if opts.Mode == WriteFailIfExists {
+			return false
+		}
+		rewound, _ := replay.rewind()
+		return rewound
+	})
+	return info, err
+}
+
+func (s *sshFS) write(client *sftpClient.Client, path string, data io.Reader, mode WriteMode, flags int) (os.FileInfo, error) {
 	// Ensure the directory exists
 	dir := filepath.Dir(path)
-	err := s.MkdirAll(dir)
+	err := client.MkdirAll(dir)
 	if err != nil {
 		return nil, fmt.Errorf("error creating directory: %w", err)
 	}
 
-	f, err := s.Create(path)
+	f, err := client.OpenFile(path, flags)
 	if err != nil {
+		// servers report an existing file with a generic failure status
+		if mode == WriteFailIfExists {
+			if _, statErr := client.Stat(path); statErr == nil {
+				return nil, conditionFailed(mode, err)
+			}
+		}
 		return nil, fmt.Errorf("error creating file: %w", err)
 	}
+	defer func() { _ = f.Close() }()
 
 	_, err = io.Copy(f, data)
 	if err != nil {
+		if mode == WriteFailIfExists {
+			// the file was created by this write
+			_ = client.Remove(path)
+		}
 		return nil, fmt.Errorf("error writing to file: %w", err)
 	}
 
 	return f.Stat()
 }
+
+func (s *sshFS) Delete(ctx gocontext.Context, path string) error {
+	// a lost connection does not tell whether the file was removed, so it is not removed again
+	return s.do(func(client *sftpClient.Client) error {
+		return client.Remove(path)
+	}, nil)
+}
+
+// isRetryableSFTP reports whether err is caused by a lost SFTP connection.
+func isRetryableSFTP(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, sftp.ErrSSHFxNoConnection)
+}
+
+// isAuthErrorSFTP reports whether the SSH handshake failed because the credentials were rejected.
+func isAuthErrorSFTP(err error) bool {
+	var authErr *sftpClient.AuthenticationError
+	return errors.As(err, &authErr)
+}
@@ -0,0 +1,289 @@
+package fs
+
+import (
+	gocontext "context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultSyncConcurrency = 4
+
+// SyncCompare decides when a file on the destination differs from the source.
+type SyncCompare string
+
+const (
+	// SyncCompareSize copies files whose size differs.
+	SyncCompareSize SyncCompare = "size"
+
+	// SyncCompareModTime copies files whose size differs, or that were modified on the source
+	// after they were written to the destination. It is the default.
+	SyncCompareModTime SyncCompare = "mtime"
+
+	// SyncCompareChecksum copies files whose size or SHA-256 differs. Both copies of every file are read.
+	SyncCompareChecksum SyncCompare = "checksum"
+)
+
+type SyncOptions struct {
+	// Root is the directory synced from the source. Defaults to the source root.
+	Root string
+
+	// DestinationRoot is the directory synced to on the destination. Defaults to the destination root.
+	DestinationRoot string
+
+	// Compare decides which files are copied. Defaults to SyncCompareModTime.
+	Compare SyncCompare
+
+	// Delete removes files from the destination that are not on the source.
+	Delete bool
+
+	// Include only syncs the files whose path, relative to the root, matches one of these globs.
+	Include []string
+
+	// Exclude skips the files whose path, relative to the root, matches one of these globs.
+	// Excluded files are never deleted from the destination.
+	Exclude []string
+
+	// DryRun reports the actions without copying or deleting anything.
+	DryRun bool
+
+	// Concurrency is the number of files copied at the same time. Defaults to 4.
+	Concurrency int
+}
+
+// SyncError is a file that could not be synced.
+type SyncError struct {
+	Path string
+	Err  error
+}
+
+// SyncReport summarizes the actions of Sync. Paths are relative to the roots.
+type SyncReport struct {
+	// Copied are the files missing on the destination.
+	Copied []string
+
+	// Updated are the files that differed on the destination.
+	Updated []string
+
+	// Deleted are the files removed from the destination.
+	Deleted []string
+
+	// Unchanged is the number of files that were already in sync.
+	Unchanged int
+
+	// Bytes is the number of bytes copied.
+	Bytes int64
+
+	Errors []SyncError
+}
+
+// Sync makes the destination a mirror of the source: files that are missing or differ are copied,
+// and with SyncOptions.Delete extraneous files are removed.
+//
+// A file that fails to sync is recorded in the report and does not stop the others;
+// the returned error is only set when either tree cannot be listed.
+// Read and write options on ctx, e.g. progress and bandwidth limits, apply to every copy.
+func Sync(ctx gocontext.Context, src, dst FilesystemRW, opts SyncOptions) (*SyncReport, error) {
+	if opts.Compare == "" {
+		opts.Compare = SyncCompareModTime
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultSyncConcurrency
+	}
+
+	for _, pattern := range append(slices.Clone(opts.Include), opts.Exclude...) {
+		if !doublestar.ValidatePattern(pattern) {
+			return nil, fmt.Errorf("invalid glob %q", pattern)
+		}
+	}
+
+	sources, err := listTree(src, opts.Root, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error listing source: %w", err)
+	}
+
+	destinations, err := listTree(dst, opts.DestinationRoot, opts)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error listing destination: %w", err)
+	}
+
+	var report SyncReport
+	var mu sync.Mutex
+	record := func(fn func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn()
+	}
+
+	var group errgroup.Group
+	group.SetLimit(concurrency)
+	for _, rel := range sortedKeys(sources) {
+		source := sources[rel]
+		destination, exists := destinations[rel]
+		group.Go(func() error {
+			srcPath, dstPath := path.Join(opts.Root, rel), path.Join(opts.DestinationRoot, rel)
+			if exists {
+				same, err := sameFile(ctx, src, dst, srcPath, dstPath, source, destination, opts.Compare)
+				if err != nil {
+					record(func() { report.Errors = append(report.Errors, SyncError{Path: rel, Err: err}) })
+					return nil
+				}
+				if same {
+					record(func() { report.Unchanged++ })
+					return nil
+				}
+			}
+
+			if !opts.DryRun {
+				if err := copyFile(ctx, src, dst, srcPath, dstPath); err != nil {
+					record(func() { report.Errors = append(report.Errors, SyncError{Path: rel, Err: err}) })
+					return nil
+				}
+			}
+
+			record(func() {
+				report.Bytes += source.Size()
+				if exists {
+					report.Updated = append(report.Updated, rel)
+				} else {
+					report.Copied = append(report.Copied, rel)
+				}
+			})
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	if opts.Delete {
+		for _, rel := range sortedKeys(destinations) {
+			if _, ok := sources[rel]; ok {
+				continue
+			}
+
+			if !opts.DryRun {
+				if err := dst.Delete(ctx, path.Join(opts.DestinationRoot, rel)); err != nil && !errors.Is(err, os.ErrNotExist) {
+					report.Errors = append(report.Errors, SyncError{Path: rel, Err: err})
+					continue
+				}
+			}
+			report.Deleted = append(report.Deleted, rel)
+		}
+	}
+
+	slices.Sort(report.Copied)
+	slices.Sort(report.Updated)
+	return &report, nil
+}
+
+// listTree returns the files beneath root that the include and exclude globs select, by their path relative to root.
+func listTree(fs Filesystem, root string, opts SyncOptions) (map[string]os.FileInfo, error) {
+	files := map[string]os.FileInfo{}
+	root = path.Clean(root)
+	err := Walk(fs, root, func(p string, info os.FileInfo) error {
+		rel := path.Clean(p)
+		if root != "." {
+			// only the files beneath the root directory, not those of a sibling sharing its name as a prefix
+			var ok bool
+			if rel, ok = strings.CutPrefix(rel, root+"/"); !ok {
+				return nil
+			}
+		}
+		if !syncSelects(rel, opts) {
+			return nil
+		}
+
+		files[rel] = info
+		return nil
+	})
+	return files, err
+}
+
+func syncSelects(rel string, opts SyncOptions) bool {
+	if len(opts.Include) > 0 && !slices.ContainsFunc(opts.Include, func(pattern string) bool { return globMatch(pattern, rel) }) {
+		return false
+	}
+
+	return !slices.ContainsFunc(opts.Exclude, func(pattern string) bool { return globMatch(pattern, rel) })
+}
+
+func globMatch(pattern, name string) bool {
+	matched, _ := doublestar.Match(pattern, name)
+	return matched
+}
+
+func sameFile(ctx gocontext.Context, src, dst FilesystemRW, srcPath, dstPath string, source, destination os.FileInfo, compare SyncCompare) (bool, error) {
+	if source.Size() != destination.Size() {
+		return false, nil
+	}
+
+	switch compare {
+	case SyncCompareSize:
+		return true, nil
+
+	case SyncCompareChecksum:
+		srcSum, err := fileChecksum(ctx, src, srcPath)
+		if err != nil {
+			return false, fmt.Errorf("error reading source: %w", err)
+		}
+
+		dstSum, err := fileChecksum(ctx, dst, dstPath)
+		if err != nil {
+			return false, fmt.Errorf("error reading destination: %w", err)
+		}
+
+		return srcSum == dstSum, nil
+
+	default:
+		return !source.ModTime().After(destination.ModTime()), nil
+	}
+}
+
+func fileChecksum(ctx gocontext.Context, fs FilesystemRW, path string) (string, error) {
+	// only the copy reports progress
+	reader, err := fs.Read(WithReadOptions(ctx, ReadOptions{Limiter: GetReadOptions(ctx).Limiter}), path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = reader.Close() }()
+
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, reader); err != nil {
+		return "", err
+	}
+
+	return string(checksum.Sum(nil)), nil
+}
+
+func copyFile(ctx gocontext.Context, src, dst FilesystemRW, srcPath, dstPath string) error {
+	reader, err := src.Read(ctx, srcPath)
+	if err != nil {
+		return fmt.Errorf("error reading source: %w", err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	if _, err := dst.Write(ctx, dstPath, reader); err != nil {
+		return fmt.Errorf("error writing destination: %w", err)
+	}
+
+	return nil
+}
+
+func sortedKeys(files map[string]os.FileInfo) []string {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
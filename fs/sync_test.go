@@ -0,0 +1,117 @@
+package fs
+
+import (
+	gocontext "context"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	ctx := gocontext.TODO()
+	src, dst := NewLocalFS(t.TempDir()), NewLocalFS(t.TempDir())
+
+	for name, content := range map[string]string{
+		"a.txt":       "a",
+		"logs/b.log":  "b",
+		"logs/c.tmp":  "c",
+		"changed.txt": "new content",
+	} {
+		if _, err := src.Write(ctx, name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{
+		"a.txt":       "a",
+		"changed.txt": "old",
+		"extra.txt":   "extra",
+	} {
+		if _, err := dst.Write(ctx, name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := SyncOptions{Compare: SyncCompareChecksum, Delete: true, Exclude: []string{"**/*.tmp"}, DryRun: true}
+	report, err := Sync(ctx, src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Copied, []string{"logs/b.log"}) || !slices.Equal(report.Updated, []string{"changed.txt"}) ||
+		!slices.Equal(report.Deleted, []string{"extra.txt"}) || report.Unchanged != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, err := dst.Stat("logs/b.log"); err == nil {
+		t.Fatal("expected a dry run to leave the destination untouched")
+	}
+
+	opts.DryRun = false
+	if report, err = Sync(ctx, src, dst, opts); err != nil {
+		t.Fatal(err)
+	} else if len(report.Errors) > 0 {
+		t.Fatalf("unexpected errors %+v", report.Errors)
+	}
+
+	reader, err := dst.Read(ctx, "changed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if content, _ := io.ReadAll(reader); string(content) != "new content" {
+		t.Errorf("expected the changed file to be copied, got %q", content)
+	}
+	if _, err := dst.Stat("extra.txt"); err == nil {
+		t.Error("expected the extraneous file to be deleted")
+	}
+	if _, err := dst.Stat("logs/c.tmp"); err == nil {
+		t.Error("expected the excluded file to be skipped")
+	}
+
+	if report, err = Sync(ctx, src, dst, opts); err != nil {
+		t.Fatal(err)
+	} else if len(report.Copied)+len(report.Updated)+len(report.Deleted) > 0 || report.Unchanged != 3 {
+		t.Errorf("expected the trees to be in sync, got %+v", report)
+	}
+}
+
+func TestListTreeSiblingPrefix(t *testing.T) {
+	store := &objectStore{keys: []string{"logs/a.txt", "logs/nested/b.txt", "logs-archive/c.txt", "logsfile.txt"}}
+
+	for root, expected := range map[string][]string{
+		"logs":          {"a.txt", "nested/b.txt"},
+		"logs/":         {"a.txt", "nested/b.txt"},
+		"logs-archive":  {"c.txt"},
+		"":              {"logs-archive/c.txt", "logs/a.txt", "logs/nested/b.txt", "logsfile.txt"},
+		"logs/nested/":  {"b.txt"},
+		"logs/missing/": nil,
+	} {
+		files, err := listTree(store, root, SyncOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		paths := slices.Sorted(maps.Keys(files))
+		if !slices.Equal(paths, expected) {
+			t.Errorf("expected %v beneath %q, got %v", expected, root, paths)
+		}
+	}
+
+	// a directory walked by its absolute path
+	dir := t.TempDir()
+	local := NewLocalFS("/")
+	for _, name := range []string{"logs/a.txt", "logs-archive/b.txt"} {
+		if _, err := local.Write(gocontext.TODO(), path.Join(dir, name), strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := listTree(local, path.Join(dir, "logs"), SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := slices.Sorted(maps.Keys(files)); !slices.Equal(paths, []string{"a.txt"}) {
+		t.Errorf("expected [a.txt] beneath %s, got %v", path.Join(dir, "logs"), paths)
+	}
+}
@@ -0,0 +1,270 @@
+package fs
+
+import (
+	"bytes"
+	gocontext "context"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// minBandwidthBurst is the smallest burst of a bandwidth limiter, so that reads are not split into tiny chunks.
+const minBandwidthBurst = 32 * 1024
+
+// ProgressFunc is called as content is transferred with the number of bytes transferred so far,
+// and the total number of bytes, or -1 if it is not known.
+type ProgressFunc func(transferred, total int64)
+
+// NewBandwidthLimiter returns a token bucket limiting transfers to bytesPerSecond.
+// Transfers that share the limiter share the bandwidth.
+func NewBandwidthLimiter(bytesPerSecond int) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), max(bytesPerSecond, minBandwidthBurst))
+}
+
+type readOptionsKey struct{}
+
+// ReadOptions adjust a single Read call.
+// They are passed to Read through its context, see WithReadOptions.
+type ReadOptions struct {
+	// Progress is called as the content is read from the returned reader.
+	Progress ProgressFunc
+
+	// Limiter throttles reading the content, see NewBandwidthLimiter.
+	Limiter *rate.Limiter
+}
+
+// WithReadOptions returns a context that applies opts to the Read calls made with it.
+func WithReadOptions(ctx gocontext.Context, opts ReadOptions) gocontext.Context {
+	return gocontext.WithValue(ctx, readOptionsKey{}, opts)
+}
+
+// GetReadOptions returns the read options carried by ctx.
+func GetReadOptions(ctx gocontext.Context) ReadOptions {
+	if opts, ok := ctx.Value(readOptionsKey{}).(ReadOptions); ok {
+		return opts
+	}
+
+	return ReadOptions{}
+}
+
+// writeTransfer wraps the content of a Write with the progress and limiter of its options.
+func writeTransfer(ctx gocontext.Context, data io.Reader) io.Reader {
+	opts := GetWriteOptions(ctx)
+	if opts.Progress == nil && opts.Limiter == nil {
+		return data
+	}
+
+	return newTransferReader(ctx, data, 0, getContentLength(data), opts.Progress, opts.Limiter)
+}
+
+// writeParts is writeTransfer for filesystems that buffer the content of a Write before sending it:
+// the returned function wraps each buffered part as it is sent, so that progress and throttling
+// apply to the upload rather than to the buffering. total is the size of the content, or -1 if it is not known.
+func writeParts(ctx gocontext.Context, total int64) func(part []byte) io.Reader {
+	opts := GetWriteOptions(ctx)
+	if opts.Progress == nil && opts.Limiter == nil {
+		return func(part []byte) io.Reader { return bytes.NewReader(part) }
+	}
+
+	var sent int64
+	return func(part []byte) io.Reader {
+		reader := newTransferReader(ctx, bytes.NewReader(part), sent, total, opts.Progress, opts.Limiter)
+		sent += int64(len(part))
+		return reader
+	}
+}
+
+// readTransfer wraps the reader returned by a Read with the progress and limiter of its options.
+// size returns the size of the content, or -1 if it is not known. It is only called when options are set.
+func readTransfer(ctx gocontext.Context, reader io.ReadCloser, size func() int64) io.ReadCloser {
+	opts := GetReadOptions(ctx)
+	if opts.Progress == nil && opts.Limiter == nil {
+		return reader
+	}
+
+	return &transferReadCloser{
+		Reader: newTransferReader(ctx, reader, 0, size(), opts.Progress, opts.Limiter),
+		closer: reader,
+	}
+}
+
+// transferReader reports progress and throttles the content read through it.
+// The content starts at offset of the whole transfer, when it is sent in parts.
+type transferReader struct {
+	ctx      gocontext.Context
+	reader   io.Reader
+	offset   int64
+	total    int64
+	n        int64
+	progress ProgressFunc
+	limiter  *rate.Limiter
+}
+
+func newTransferReader(ctx gocontext.Context, reader io.Reader, offset, total int64, progress ProgressFunc, limiter *rate.Limiter) io.Reader {
+	transfer := &transferReader{ctx: ctx, reader: reader, offset: offset, n: offset, total: total, progress: progress, limiter: limiter}
+	if seeker, ok := reader.(io.Seeker); ok {
+		// seekable content stays seekable, so that it can be replayed and uploaded with a known length
+		return &transferReadSeeker{transferReader: transfer, seeker: seeker}
+	}
+	return transfer
+}
+
+func (t *transferReader) Read(p []byte) (int, error) {
+	if t.limiter != nil && len(p) > t.limiter.Burst() {
+		p = p[:t.limiter.Burst()]
+	}
+
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		if t.limiter != nil {
+			if waitErr := t.limiter.WaitN(t.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+
+		t.n += int64(n)
+		if t.progress != nil {
+			t.progress(t.n, t.total)
+		}
+	}
+
+	return n, err
+}
+
+// ContentLength returns the total size of the content if known, -1 otherwise
+func (t *transferReader) ContentLength() int64 {
+	return t.total
+}
+
+type transferReadSeeker struct {
+	*transferReader
+	seeker io.Seeker
+}
+
+func (t *transferReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	position, err := t.seeker.Seek(offset, whence)
+	if err == nil {
+		t.n = t.offset + position
+	}
+	return position, err
+}
+
+// ContentLength returns the total size of the content if known, -1 otherwise
+func (t *transferReadSeeker) ContentLength() int64 {
+	return t.total
+}
+
+type transferReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (t *transferReadCloser) Close() error {
+	return t.closer.Close()
+}
+
+// fileSize returns the size of an open file, or -1 if it cannot be determined.
+func fileSize(file interface{ Stat() (os.FileInfo, error) }) func() int64 {
+	return func() int64 {
+		if info, err := file.Stat(); err == nil {
+			return info.Size()
+		}
+		return -1
+	}
+}
+
+// throttledFS implements FilesystemRW, throttling the reads and writes of another filesystem with a shared limiter.
+// A limiter passed in the options of a single call takes precedence.
+type throttledFS struct {
+	FilesystemRW
+	limiter *rate.Limiter
+
+	// release drops the filesystem's reference to a shared limiter once it is closed
+	release func()
+	once    sync.Once
+}
+
+// NewThrottledFS limits the bandwidth of fs to that of limiter, see NewBandwidthLimiter.
+func NewThrottledFS(fs FilesystemRW, limiter *rate.Limiter) *throttledFS {
+	return &throttledFS{FilesystemRW: fs, limiter: limiter}
+}
+
+// sharedLimiters are the limiters of NewSharedThrottledFS by key, with the number of open filesystems sharing them.
+var sharedLimiters = struct {
+	sync.Mutex
+	limiters map[string]*sharedLimiter
+}{limiters: map[string]*sharedLimiter{}}
+
+type sharedLimiter struct {
+	*rate.Limiter
+	refs int
+}
+
+// NewSharedThrottledFS limits the bandwidth of fs to bytesPerSecond, shared by the open filesystems with the same key.
+// The limiter is dropped once the last of them is closed.
+func NewSharedThrottledFS(fs FilesystemRW, key string, bytesPerSecond int) *throttledFS {
+	sharedLimiters.Lock()
+	defer sharedLimiters.Unlock()
+
+	shared, ok := sharedLimiters.limiters[key]
+	if !ok {
+		shared = &sharedLimiter{Limiter: NewBandwidthLimiter(bytesPerSecond)}
+		sharedLimiters.limiters[key] = shared
+	}
+	shared.refs++
+
+	release := func() {
+		sharedLimiters.Lock()
+		defer sharedLimiters.Unlock()
+
+		if shared.refs--; shared.refs == 0 {
+			delete(sharedLimiters.limiters, key)
+		}
+	}
+
+	return &throttledFS{FilesystemRW: fs, limiter: shared.Limiter, release: release}
+}
+
+func (t *throttledFS) Close() error {
+	err := t.FilesystemRW.Close()
+	if t.release != nil {
+		t.once.Do(t.release)
+	}
+	return err
+}
+
+func (t *throttledFS) Read(ctx gocontext.Context, path string) (io.ReadCloser, error) {
+	opts := GetReadOptions(ctx)
+	if opts.Limiter == nil {
+		opts.Limiter = t.limiter
+	}
+
+	return t.FilesystemRW.Read(WithReadOptions(ctx, opts), path)
+}
+
+func (t *throttledFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
+	opts := GetWriteOptions(ctx)
+	if opts.Limiter == nil {
+		opts.Limiter = t.limiter
+	}
+
+	return t.FilesystemRW.Write(WithWriteOptions(ctx, opts), path, data)
+}
+
+func (t *throttledFS) SetMaxListItems(max int) {
+	setMaxListItems(t.FilesystemRW, max)
+}
+
+func (t *throttledFS) SetServerSideEncryption(sse *ServerSideEncryption) {
+	setServerSideEncryption(t.FilesystemRW, sse)
+}
+
+func (t *throttledFS) Health() SessionHealth {
+	return health(t.FilesystemRW)
+}
+
+func (t *throttledFS) ReadDirTruncated(name string) ([]FileInfo, bool, error) {
+	return readDir(t.FilesystemRW, name)
+}
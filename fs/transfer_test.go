@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"bytes"
+	gocontext "context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestTransferProgress(t *testing.T) {
+	local := NewLocalFS(t.TempDir())
+	content := bytes.Repeat([]byte("a"), 100*1024)
+
+	var written, total int64
+	ctx := WithWriteOptions(gocontext.TODO(), WriteOptions{
+		Progress: func(n, size int64) { written, total = n, size },
+		Limiter:  NewBandwidthLimiter(10 * 1024 * 1024),
+	})
+	if _, err := local.Write(ctx, "a.bin", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(len(content)) || total != int64(len(content)) {
+		t.Errorf("expected progress of %d/%d bytes, got %d/%d", len(content), len(content), written, total)
+	}
+
+	var read int64
+	reader, err := local.Read(WithReadOptions(gocontext.TODO(), ReadOptions{
+		Progress: func(n, size int64) { read, total = n, size },
+	}), "a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		t.Fatal(err)
+	}
+	if read != int64(len(content)) || total != int64(len(content)) {
+		t.Errorf("expected progress of %d/%d bytes, got %d/%d", len(content), len(content), read, total)
+	}
+}
+
+func TestSharedThrottledFS(t *testing.T) {
+	first := NewSharedThrottledFS(NewLocalFS(t.TempDir()), "connection", 1024)
+	second := NewSharedThrottledFS(NewLocalFS(t.TempDir()), "connection", 1024)
+	if first.limiter != second.limiter {
+		t.Error("expected filesystems with the same key to share a limiter")
+	}
+
+	_ = first.Close()
+	_ = first.Close()
+	if _, ok := sharedLimiters.limiters["connection"]; !ok {
+		t.Fatal("expected the limiter to be kept while a filesystem still uses it")
+	}
+
+	_ = second.Close()
+	if _, ok := sharedLimiters.limiters["connection"]; ok {
+		t.Error("expected the limiter to be dropped once every filesystem was closed")
+	}
+}
+
+func TestThrottledFSForwardsOptionalInterfaces(t *testing.T) {
+	s3, requests := newFakeS3(t)
+	var wrapped FilesystemRW = NewThrottledFS(s3, NewBandwidthLimiter(1024*1024))
+
+	limiter, ok := wrapped.(ListItemLimiter)
+	if !ok {
+		t.Fatal("expected the wrapper to forward SetMaxListItems")
+	}
+	limiter.SetMaxListItems(1)
+
+	if _, ok := wrapped.(ServerSideEncrypter); !ok {
+		t.Error("expected the wrapper to forward SetServerSideEncryption")
+	}
+
+	_, truncated, err := wrapped.(TruncatingLister).ReadDirTruncated(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("expected the truncation of the listing to be forwarded")
+	}
+	if query := requests()[0].Query; !strings.Contains(query, "max-keys=1") {
+		t.Errorf("expected the listing limit to reach the filesystem, got %s", query)
+	}
+}
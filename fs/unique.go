@@ -0,0 +1,35 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxUniquePathAttempts bounds the number of suffixes UniquePath tries.
+const maxUniquePathAttempts = 1000
+
+// UniquePath returns path if nothing is stored there yet, otherwise the first free path
+// with a numeric suffix before the extension, e.g. report-1.json, report-2.json.
+//
+// The path is only free at the time of the check; concurrent writers can still race for it.
+func UniquePath(fs Filesystem, path string) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	candidate := path
+	for i := 1; i <= maxUniquePathAttempts; i++ {
+		if _, err := fs.Stat(candidate); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return candidate, nil
+			}
+			return "", fmt.Errorf("error checking if %s exists: %w", candidate, err)
+		}
+
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+
+	return "", fmt.Errorf("no unique path found for %s after %d attempts", path, maxUniquePathAttempts)
+}
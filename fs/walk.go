@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+)
+
+// ErrListTruncated is returned by Walk when a listing stopped at the maximum number of entries
+// of the filesystem, see ListItemLimiter. The files beneath root were only walked in part.
+var ErrListTruncated = errors.New("listing truncated")
+
+// WalkFunc is called by Walk for every file.
+// path is relative to the filesystem root the walk started from.
+type WalkFunc func(path string, info os.FileInfo) error
+
+// Walk calls fn for every file beneath root, descending into directories.
+//
+// Object stores (S3, GCS) list recursively and report the full key as the name,
+// so those entries are passed through unchanged instead of being descended into.
+// When a listing was cut short, the entries listed are walked and ErrListTruncated is returned.
+func Walk(fs Filesystem, root string, fn WalkFunc) error {
+	root = path.Clean(root)
+
+	truncated, err := walk(fs, root, root, fn)
+	if err != nil {
+		return err
+	}
+	if truncated {
+		return ErrListTruncated
+	}
+
+	return nil
+}
+
+func walk(fs Filesystem, root, dir string, fn WalkFunc) (bool, error) {
+	entries, truncated, err := readDir(fs, dir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range entries {
+		if object, ok := entry.(ObjectInfo); ok {
+			key := object.Key()
+			if entry.IsDir() || !withinRoot(root, key) {
+				continue // directory marker, or a key that merely shares the prefix
+			}
+
+			if err := fn(key, entry); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		fullpath := path.Join(dir, entry.Name())
+		if entry.IsDir() {
+			nestedTruncated, err := walk(fs, root, fullpath, fn)
+			if err != nil {
+				return false, err
+			}
+			truncated = truncated || nestedTruncated
+			continue
+		}
+
+		if err := fn(fullpath, entry); err != nil {
+			return false, err
+		}
+	}
+
+	return truncated, nil
+}
+
+// withinRoot reports whether the key is beneath the root directory.
+func withinRoot(root, key string) bool {
+	return root == "." || strings.HasPrefix(key, root+"/")
+}
+
+// readDir lists a directory, reporting whether the listing was cut short where the filesystem tells.
+func readDir(fs Filesystem, name string) ([]FileInfo, bool, error) {
+	if lister, ok := fs.(TruncatingLister); ok {
+		return lister.ReadDirTruncated(name)
+	}
+
+	entries, err := fs.ReadDir(name)
+	return entries, false, err
+}
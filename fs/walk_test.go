@@ -0,0 +1,114 @@
+package fs
+
+import (
+	gocontext "context"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWalk(t *testing.T) {
+	local := NewLocalFS(t.TempDir())
+	for _, name := range []string{"a.txt", "dir/b.txt", "dir/nested/c.txt"} {
+		if _, err := local.Write(gocontext.TODO(), name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var paths []string
+	err := Walk(local, "", func(path string, info os.FileInfo) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(paths)
+	expected := []string{"a.txt", "dir/b.txt", "dir/nested/c.txt"}
+	if !slices.Equal(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+}
+
+// objectInfo is the file info of an object store entry, named by its full key.
+type objectInfo struct {
+	key string
+}
+
+func (o objectInfo) Name() string       { return o.key }
+func (o objectInfo) FullPath() string   { return o.key }
+func (o objectInfo) Key() string        { return o.key }
+func (o objectInfo) Size() int64        { return int64(len(o.key)) }
+func (o objectInfo) Mode() os.FileMode  { return 0644 }
+func (o objectInfo) ModTime() time.Time { return time.Time{} }
+func (o objectInfo) IsDir() bool        { return strings.HasSuffix(o.key, "/") }
+func (o objectInfo) Sys() any           { return nil }
+
+// objectStore lists its keys by raw prefix, like S3 and GCS, up to maxObjects keys.
+type objectStore struct {
+	keys       []string
+	maxObjects int
+}
+
+func (s *objectStore) Close() error                          { return nil }
+func (s *objectStore) Stat(name string) (os.FileInfo, error) { return nil, os.ErrNotExist }
+
+func (s *objectStore) ReadDir(name string) ([]FileInfo, error) {
+	entries, _, err := s.ReadDirTruncated(name)
+	return entries, err
+}
+
+func (s *objectStore) ReadDirTruncated(name string) ([]FileInfo, bool, error) {
+	var entries []FileInfo
+	for _, key := range s.keys {
+		if !strings.HasPrefix(key, strings.TrimSuffix(name, ".")) {
+			continue
+		}
+		if s.maxObjects > 0 && len(entries) == s.maxObjects {
+			return entries, true, nil
+		}
+		entries = append(entries, objectInfo{key: key})
+	}
+	return entries, false, nil
+}
+
+func TestWalkObjectStore(t *testing.T) {
+	store := &objectStore{keys: []string{"logs/", "logs/a.txt", "logs/nested/b.txt", "logs-archive/c.txt", "top.txt"}}
+
+	walked := func(root string) ([]string, error) {
+		var paths []string
+		err := Walk(store, root, func(path string, info os.FileInfo) error {
+			paths = append(paths, path)
+			return nil
+		})
+		slices.Sort(paths)
+		return paths, err
+	}
+
+	for root, expected := range map[string][]string{
+		"logs":  {"logs/a.txt", "logs/nested/b.txt"},
+		"logs/": {"logs/a.txt", "logs/nested/b.txt"},
+		"":      {"logs-archive/c.txt", "logs/a.txt", "logs/nested/b.txt", "top.txt"},
+	} {
+		paths, err := walked(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(paths, expected) {
+			t.Errorf("root %q: expected %v, got %v", root, expected, paths)
+		}
+	}
+
+	store.maxObjects = 2
+	paths, err := walked("logs")
+	if !errors.Is(err, ErrListTruncated) {
+		t.Errorf("expected ErrListTruncated, got %v", err)
+	}
+	if expected := []string{"logs/a.txt"}; !slices.Equal(paths, expected) {
+		t.Errorf("expected the listed keys %v to be walked, got %v", expected, paths)
+	}
+}
@@ -0,0 +1,102 @@
+package fs
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// openFlags returns the flags a file is created with by filesystems that write through os.OpenFile semantics.
+func openFlags(mode WriteMode) (int, error) {
+	switch mode {
+	case "", WriteOverwrite:
+		return os.O_WRONLY | os.O_CREATE | os.O_TRUNC, nil
+	case WriteFailIfExists:
+		return os.O_WRONLY | os.O_CREATE | os.O_EXCL, nil
+	default:
+		return 0, fmt.Errorf("%w: write mode %s", errors.ErrUnsupported, mode)
+	}
+}
+
+// writeWithSuffix writes to the first free path with a numeric suffix, moving on to the next one
+// when another writer takes the path first. Content that has been partially consumed and cannot be
+// rewound is not retried.
+func writeWithSuffix(ctx gocontext.Context, fs FilesystemRW, path string, data io.Reader) (os.FileInfo, error) {
+	opts := GetWriteOptions(ctx)
+	opts.Mode = WriteFailIfExists
+	ctx = WithWriteOptions(ctx, opts)
+
+	replay, err := newReplayableReader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for range maxUniquePathAttempts {
+		candidate, err := UniquePath(fs, path)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := fs.Write(ctx, candidate, replay.reader)
+		if err == nil || !errors.Is(err, ErrAlreadyExists) {
+			return info, err
+		}
+
+		if rewound, rewindErr := replay.rewind(); !rewound {
+			return nil, errors.Join(err, rewindErr)
+		}
+	}
+
+	return nil, fmt.Errorf("no unique path found for %s after %d attempts", path, maxUniquePathAttempts)
+}
+
+// replayableReader rewinds seekable content, and detects whether other content has been read from yet.
+type replayableReader struct {
+	reader io.Reader
+	seeker io.Seeker
+	offset int64
+	read   *readTracker
+}
+
+func newReplayableReader(data io.Reader) (*replayableReader, error) {
+	if seeker, ok := data.(io.Seeker); ok {
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		return &replayableReader{reader: data, seeker: seeker, offset: offset}, nil
+	}
+
+	tracker := &readTracker{Reader: data}
+	return &replayableReader{reader: tracker, read: tracker}, nil
+}
+
+// rewind reports whether the content can be written again from the start.
+func (t *replayableReader) rewind() (bool, error) {
+	if t.seeker != nil {
+		if _, err := t.seeker.Seek(t.offset, io.SeekStart); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	return t.read.n == 0, nil
+}
+
+type readTracker struct {
+	io.Reader
+	n int64
+}
+
+func (t *readTracker) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	t.n += int64(n)
+	return n, err
+}
+
+// ContentLength returns the length of the wrapped content if known, -1 otherwise
+func (t *readTracker) ContentLength() int64 {
+	return getContentLength(t.Reader)
+}
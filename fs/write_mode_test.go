@@ -0,0 +1,46 @@
+package fs
+
+import (
+	gocontext "context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriteModes(t *testing.T) {
+	local := NewLocalFS(t.TempDir())
+	if _, err := local.Write(gocontext.TODO(), "dir/report.json", strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	failIfExists := WithWriteOptions(gocontext.TODO(), WriteOptions{Mode: WriteFailIfExists})
+	if _, err := local.Write(failIfExists, "dir/report.json", strings.NewReader("second")); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("expected ErrAlreadyExists, got %v", err)
+	}
+
+	rename := WithWriteOptions(gocontext.TODO(), WriteOptions{Mode: WriteRenameWithSuffix})
+	for _, expected := range []string{"report-1.json", "report-2.json"} {
+		info, err := local.Write(rename, "dir/report.json", strings.NewReader(expected))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name() != expected {
+			t.Errorf("expected %s, got %s", expected, info.Name())
+		}
+	}
+
+	reader, err := local.Read(gocontext.TODO(), "dir/report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "first" {
+		t.Errorf("expected the original content to be kept, got %q", content)
+	}
+}
@@ -0,0 +1,207 @@
+package artifacts
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+)
+
+const (
+	// maxLabelValueLength is the longest label value.
+	maxLabelValueLength = 256
+
+	// maxLabelsSize is the combined size of the keys and values of an artifact's labels.
+	// S3 limits the user-defined metadata of an object to 2 KB.
+	maxLabelsSize = 2 * 1024
+
+	// labelQueryBatchSize is the number of artifacts whose labels are loaded per query.
+	labelQueryBatchSize = 1000
+)
+
+// ErrLabelsNotMigrated is returned when labels are saved or queried before MigrateArtifactLabels was run.
+var ErrLabelsNotMigrated = errors.New("the artifact_labels table does not exist, see MigrateArtifactLabels")
+
+// labelKeyPattern only allows keys that S3 stores as given: it lowercases the keys of user-defined metadata.
+var labelKeyPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,61}[a-z0-9])?$`)
+
+// artifactLabelsSchema creates the artifact_labels table that labels are stored in.
+var artifactLabelsSchema = []string{
+	`CREATE TABLE IF NOT EXISTS artifact_labels (
+		artifact_id UUID NOT NULL REFERENCES artifacts(id) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (artifact_id, key)
+	)`,
+	`CREATE INDEX IF NOT EXISTS artifact_labels_key_value_idx ON artifact_labels (key, value)`,
+}
+
+// MigrateArtifactLabels creates the artifact_labels table if it does not exist, as duty's schema does not have it.
+// It must have been run before artifacts with labels are saved or ListArtifacts is called,
+// which otherwise fail with ErrLabelsNotMigrated.
+func MigrateArtifactLabels(ctx context.Context) error {
+	for _, statement := range artifactLabelsSchema {
+		if err := ctx.DB().Exec(statement).Error; err != nil {
+			return fmt.Errorf("error migrating artifact labels: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// labelsMigrated fails with ErrLabelsNotMigrated when the artifact_labels table does not exist.
+func labelsMigrated(ctx context.Context) error {
+	if !ctx.DB().Migrator().HasTable(ArtifactLabel{}) {
+		return ErrLabelsNotMigrated
+	}
+	return nil
+}
+
+// ArtifactLabel is a label of an artifact, as stored in the artifact_labels table.
+type ArtifactLabel struct {
+	ArtifactID uuid.UUID `gorm:"primaryKey"`
+	Key        string    `gorm:"primaryKey"`
+	Value      string
+}
+
+func (ArtifactLabel) TableName() string {
+	return "artifact_labels"
+}
+
+// InvalidLabelError is returned when saving an artifact with a label that cannot be stored on every backend.
+type InvalidLabelError struct {
+	Key    string
+	Reason string
+}
+
+func (e *InvalidLabelError) Error() string {
+	return fmt.Sprintf("invalid artifact label %q: %s", e.Key, e.Reason)
+}
+
+// validateLabels checks that the labels can be stored as user-defined metadata on S3 and GCS:
+// keys are lowercase alphanumerics, '.', '_' and '-' of at most 63 characters,
+// and values printable ASCII of at most 256 characters.
+func validateLabels(labels map[string]string) error {
+	var size int
+	for key, value := range labels {
+		if !labelKeyPattern.MatchString(key) {
+			return &InvalidLabelError{Key: key, Reason: "keys must be at most 63 lowercase alphanumerics, '.', '_' or '-', starting and ending with an alphanumeric"}
+		}
+
+		if len(value) > maxLabelValueLength {
+			return &InvalidLabelError{Key: key, Reason: fmt.Sprintf("values must be at most %d characters", maxLabelValueLength)}
+		}
+
+		for _, c := range []byte(value) {
+			if c < 0x20 || c > 0x7e {
+				return &InvalidLabelError{Key: key, Reason: "values must be printable ASCII"}
+			}
+		}
+
+		size += len(key) + len(value)
+	}
+
+	if size > maxLabelsSize {
+		return &InvalidLabelError{Reason: fmt.Sprintf("labels must be at most %d bytes in total", maxLabelsSize)}
+	}
+
+	return nil
+}
+
+// createLabels inserts the labels of a saved artifact.
+func createLabels(ctx context.Context, artifactID uuid.UUID, labels map[string]string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+	if err := labelsMigrated(ctx); err != nil {
+		return err
+	}
+
+	rows := make([]ArtifactLabel, 0, len(labels))
+	for key, value := range labels {
+		rows = append(rows, ArtifactLabel{ArtifactID: artifactID, Key: key, Value: value})
+	}
+
+	if err := ctx.DB().Create(&rows).Error; err != nil {
+		return fmt.Errorf("error saving labels of artifact(%s): %w", artifactID, err)
+	}
+
+	return nil
+}
+
+// ArtifactQuery selects the artifacts returned by ListArtifacts.
+type ArtifactQuery struct {
+	// ConnectionID is the connection the artifacts are stored on.
+	ConnectionID uuid.UUID
+
+	// Optional: only artifacts of this check
+	CheckID *uuid.UUID
+
+	// Optional: only artifacts of this playbook run action
+	PlaybookRunActionID *uuid.UUID
+
+	// Optional: only artifacts that have all of these labels
+	Labels map[string]string
+}
+
+// LabeledArtifact is an artifact row together with the labels it was saved with.
+type LabeledArtifact struct {
+	models.Artifact
+	Labels map[string]string
+}
+
+// ListArtifacts returns the artifacts of a connection matching the query, with their labels.
+// Labels are read from the artifact_labels table, see MigrateArtifactLabels.
+func ListArtifacts(ctx context.Context, query ArtifactQuery) ([]LabeledArtifact, error) {
+	if err := labelsMigrated(ctx); err != nil {
+		return nil, err
+	}
+
+	db := ctx.DB().Where("connection_id = ? AND deleted_at IS NULL", query.ConnectionID)
+	if query.CheckID != nil {
+		db = db.Where("check_id = ?", *query.CheckID)
+	}
+	if query.PlaybookRunActionID != nil {
+		db = db.Where("playbook_run_action_id = ?", *query.PlaybookRunActionID)
+	}
+
+	keys := lo.Keys(query.Labels)
+	slices.Sort(keys)
+	for _, key := range keys {
+		db = db.Where("EXISTS (SELECT 1 FROM artifact_labels WHERE artifact_labels.artifact_id = artifacts.id AND artifact_labels.key = ? AND artifact_labels.value = ?)", key, query.Labels[key])
+	}
+
+	var rows []models.Artifact
+	if err := db.Order("created_at").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("error listing artifacts for connection(%s): %w", query.ConnectionID, err)
+	}
+
+	labels := make(map[uuid.UUID]map[string]string, len(rows))
+	for _, batch := range lo.Chunk(rows, labelQueryBatchSize) {
+		ids := lo.Map(batch, func(a models.Artifact, _ int) uuid.UUID { return a.ID })
+
+		var labelRows []ArtifactLabel
+		if err := ctx.DB().Where("artifact_id IN ?", ids).Find(&labelRows).Error; err != nil {
+			return nil, fmt.Errorf("error listing artifact labels for connection(%s): %w", query.ConnectionID, err)
+		}
+
+		for _, label := range labelRows {
+			if labels[label.ArtifactID] == nil {
+				labels[label.ArtifactID] = map[string]string{}
+			}
+			labels[label.ArtifactID][label.Key] = label.Value
+		}
+	}
+
+	result := make([]LabeledArtifact, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, LabeledArtifact{Artifact: row, Labels: labels[row.ID]})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,90 @@
+package artifacts
+
+import (
+	"errors"
+	"testing"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+)
+
+func TestListArtifacts(t *testing.T) {
+	ctx := newTestContext(t)
+	fs := artifactFS.NewLocalFS(t.TempDir())
+	connectionID := uuid.New()
+
+	for path, labels := range map[string]map[string]string{
+		"prod-critical.log": {"env": "prod", "severity": "critical"},
+		"prod-info.log":     {"env": "prod", "severity": "info"},
+		"dev.log":           {"env": "dev"},
+		"unlabeled.log":     nil,
+	} {
+		err := SaveArtifact(ctx, fs, &models.Artifact{ConnectionID: connectionID}, Artifact{Path: path, Content: streamed(path), ContentLength: -1, Labels: labels})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	artifacts, err := ListArtifacts(ctx, ArtifactQuery{ConnectionID: connectionID, Labels: map[string]string{"env": "prod", "severity": "critical"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts) != 1 || artifacts[0].Path != "prod-critical.log" {
+		t.Fatalf("expected only prod-critical.log, got %+v", artifacts)
+	}
+	if artifacts[0].Labels["severity"] != "critical" || len(artifacts[0].Labels) != 2 {
+		t.Errorf("expected the labels of the artifact, got %v", artifacts[0].Labels)
+	}
+
+	artifacts, err = ListArtifacts(ctx, ArtifactQuery{ConnectionID: connectionID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts) != 4 {
+		t.Errorf("expected all 4 artifacts without a label filter, got %d", len(artifacts))
+	}
+}
+
+func TestInvalidLabels(t *testing.T) {
+	ctx := newTestContext(t)
+	fs := artifactFS.NewLocalFS(t.TempDir())
+
+	for name, labels := range map[string]map[string]string{
+		"uppercase key":   {"Env": "prod"},
+		"key with spaces": {"build number": "1"},
+		"non-ASCII value": {"owner": "José"},
+		"control value":   {"note": "line\nbreak"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := SaveArtifact(ctx, fs, &models.Artifact{ConnectionID: uuid.New()}, Artifact{Path: "labeled.log", Content: streamed("content"), ContentLength: -1, Labels: labels})
+
+			var invalid *InvalidLabelError
+			if !errors.As(err, &invalid) {
+				t.Errorf("expected InvalidLabelError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLabelsNotMigrated(t *testing.T) {
+	ctx := newTestContext(t)
+	fs := artifactFS.NewLocalFS(t.TempDir())
+	if err := ctx.DB().Exec("DROP TABLE artifact_labels").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	err := SaveArtifact(ctx, fs, &models.Artifact{ConnectionID: uuid.New()}, Artifact{Path: "labeled.txt", Content: streamed("labeled"), ContentLength: -1, Labels: map[string]string{"env": "prod"}})
+	if !errors.Is(err, ErrLabelsNotMigrated) {
+		t.Errorf("expected saving labels to fail with ErrLabelsNotMigrated, got %v", err)
+	}
+
+	err = SaveArtifact(ctx, fs, &models.Artifact{ConnectionID: uuid.New()}, Artifact{Path: "unlabeled.txt", Content: streamed("unlabeled"), ContentLength: -1})
+	if err != nil {
+		t.Errorf("expected an artifact without labels to be saved, got %v", err)
+	}
+
+	if _, err := ListArtifacts(ctx, ArtifactQuery{ConnectionID: uuid.New()}); !errors.Is(err, ErrLabelsNotMigrated) {
+		t.Errorf("expected listing to fail with ErrLabelsNotMigrated, got %v", err)
+	}
+}
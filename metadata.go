@@ -0,0 +1,117 @@
+package artifacts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+)
+
+// MetadataSuffix is appended to an artifact's path to form the path of its metadata sidecar.
+const MetadataSuffix = ".metadata.json"
+
+// Metadata records how an artifact was stored, for the details the artifacts table has no column for.
+//
+// It is kept in a sidecar file next to the blob, which is only written when there is something to record.
+type Metadata struct {
+	// ContentEncoding is the compression applied to the blob. Empty when stored as is.
+	ContentEncoding string `json:"content_encoding,omitempty"`
+
+	// Size is the size of the content before compression.
+	Size int64 `json:"size,omitempty"`
+
+	// Checksums are the hex encoded checksums of the content requested with Artifact.Checksums.
+	Checksums map[ChecksumAlgorithm]string `json:"checksums,omitempty"`
+
+	// Labels are the labels the artifact was saved with, see Artifact.Labels.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Redactions is the number of secrets masked per pattern, see Artifact.Redaction.
+	Redactions map[string]int `json:"redactions,omitempty"`
+
+	// Signature is the base64 encoded signature of the SHA-256 digest of the content, see Artifact.Signer.
+	Signature      string `json:"signature,omitempty"`
+	SignatureKeyID string `json:"signature_key_id,omitempty"`
+}
+
+func (t Metadata) IsEmpty() bool {
+	return t.ContentEncoding == "" && len(t.Checksums) == 0 && len(t.Labels) == 0 && len(t.Redactions) == 0 && t.Signature == ""
+}
+
+func metadataPath(artifactPath string) string {
+	return artifactPath + MetadataSuffix
+}
+
+// IsMetadataPath reports whether path is the metadata sidecar of an artifact.
+func IsMetadataPath(path string) bool {
+	return strings.HasSuffix(path, MetadataSuffix)
+}
+
+func writeMetadata(ctx context.Context, fs artifactFS.FilesystemRW, artifactPath string, metadata Metadata) error {
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	// the sidecar belongs to the blob just written, so it always replaces an existing one
+	opts := artifactFS.GetWriteOptions(ctx)
+	opts.Mode = artifactFS.WriteOverwrite
+	opts.IfMatch = ""
+	opts.Metadata = nil
+	opts.Progress = nil
+
+	_, err = fs.Write(artifactFS.WithWriteOptions(ctx, opts), metadataPath(artifactPath), bytes.NewReader(content))
+	return err
+}
+
+// ReadMetadata returns the metadata stored beside the artifact at the given path.
+// Artifacts without a sidecar have empty metadata.
+func ReadMetadata(ctx context.Context, fs artifactFS.FilesystemRW, artifactPath string) (*Metadata, error) {
+	// progress is only reported for the artifact itself
+	readOptions := artifactFS.GetReadOptions(ctx)
+	readOptions.Progress = nil
+
+	reader, err := fs.Read(artifactFS.WithReadOptions(ctx, readOptions), metadataPath(artifactPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Metadata{}, nil
+		}
+		return nil, err
+	}
+	defer func() { _ = reader.Close() }()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if artifactFS.IsEncrypted(content) {
+		return nil, fmt.Errorf("metadata of artifact(%s) is encrypted: read it through an encrypted filesystem", artifactPath)
+	}
+
+	var metadata Metadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, fmt.Errorf("error parsing metadata of artifact(%s): %w", artifactPath, err)
+	}
+
+	return &metadata, nil
+}
+
+// deleteBlob deletes the artifact's blob together with its metadata sidecar.
+// Files that are already gone are not an error.
+func deleteBlob(ctx context.Context, fs artifactFS.FilesystemRW, artifactPath string) error {
+	var errs []error
+	for _, p := range []string{artifactPath, metadataPath(artifactPath)} {
+		if err := fs.Delete(ctx, p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,198 @@
+package artifacts
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+)
+
+type MigrationOptions struct {
+	// DestinationConnectionID is the connection recorded on the migrated artifact rows.
+	DestinationConnectionID uuid.UUID
+
+	// Optional: directory the artifacts are placed under on the destination, keeping their paths beneath it.
+	PathPrefix string
+
+	// DeleteSource deletes the source blob once its row points at the destination.
+	DeleteSource bool
+
+	// DryRun reports the artifacts that would be migrated without copying or updating anything.
+	DryRun bool
+}
+
+// MigrationError is an artifact that failed to migrate, see MigrationResult.Failed,
+// or whose source blob could not be deleted after it migrated, see MigrationResult.SourceCleanupFailed.
+type MigrationError struct {
+	Artifact models.Artifact
+	Err      error
+}
+
+func (t MigrationError) Error() string {
+	return fmt.Sprintf("error migrating artifact(%s): %v", t.Artifact.Path, t.Err)
+}
+
+func (t MigrationError) Unwrap() error {
+	return t.Err
+}
+
+type MigrationResult struct {
+	// Migrated is the number of artifacts whose row now points at the destination.
+	Migrated int
+
+	// Bytes is the combined size of the migrated artifacts.
+	Bytes int64
+
+	// Reused is the number of migrated artifacts already on the destination from an earlier, interrupted run.
+	Reused int
+
+	// Failed are the artifacts that could not be migrated. Their rows still point at the source.
+	Failed []MigrationError
+
+	// SourceCleanupFailed are migrated artifacts whose source blob could not be deleted, see MigrationOptions.DeleteSource.
+	// Their rows point at the destination.
+	SourceCleanupFailed []MigrationError
+}
+
+// MigrateArtifacts moves every artifact of the source connection to the destination filesystem
+// and rewrites the connection and path of its row.
+//
+// Blobs are copied as stored, with their metadata, and the copy is verified against the checksum of the row
+// before the row is updated. Each row is updated on its own, so an interrupted migration is resumed by running
+// it again: only the rows still on the source connection are migrated, and copies left on the destination
+// by the earlier run are reused once verified.
+// An artifact that fails is recorded in the result and its row keeps pointing at the source.
+// A source blob that cannot be deleted afterwards is recorded separately, as its artifact was migrated.
+//
+// Encrypted artifacts are verified by reading them back, so both filesystems must then be
+// artifactFS.NewEncryptedFS with the key provider they were saved with.
+func MigrateArtifacts(ctx context.Context, sourceConnectionID uuid.UUID, src, dst artifactFS.FilesystemRW, opts MigrationOptions) (*MigrationResult, error) {
+	if opts.DestinationConnectionID == uuid.Nil {
+		return nil, errors.New("destination connection is required")
+	}
+
+	var rows []models.Artifact
+	if err := ctx.DB().Where("connection_id = ? AND deleted_at IS NULL", sourceConnectionID).Order("created_at").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("error listing artifacts for connection(%s): %w", sourceConnectionID, err)
+	}
+
+	var result MigrationResult
+	for _, row := range rows {
+		if opts.DryRun {
+			result.Migrated++
+			result.Bytes += row.Size
+			continue
+		}
+
+		reused, err := migrateArtifact(ctx, src, dst, row, opts)
+		if err != nil {
+			result.Failed = append(result.Failed, MigrationError{Artifact: row, Err: err})
+			continue
+		}
+
+		result.Migrated++
+		result.Bytes += row.Size
+		if reused {
+			result.Reused++
+		}
+
+		// within the same filesystem and path the source is the destination
+		if opts.DeleteSource && (src != dst || path.Join(opts.PathPrefix, row.Path) != row.Path) {
+			// a blob shared with an artifact still on the source is deleted once that one migrated
+			shared, err := referencedBlobs(ctx, sourceConnectionID, []string{row.Path}, nil)
+			if err != nil {
+				result.SourceCleanupFailed = append(result.SourceCleanupFailed, MigrationError{Artifact: row, Err: err})
+				continue
+			}
+			if shared[row.Path] {
+				continue
+			}
+			if err := deleteBlob(ctx, src, row.Path); err != nil {
+				result.SourceCleanupFailed = append(result.SourceCleanupFailed, MigrationError{Artifact: row, Err: fmt.Errorf("error deleting source: %w", err)})
+			}
+		}
+	}
+
+	return &result, nil
+}
+
+func migrateArtifact(ctx context.Context, src, dst artifactFS.FilesystemRW, row models.Artifact, opts MigrationOptions) (bool, error) {
+	migrated := row
+	migrated.Path = path.Join(opts.PathPrefix, row.Path)
+
+	// a copy left behind by an interrupted run is reused once it checks out
+	reused := verifyMigratedArtifact(ctx, dst, migrated) == nil
+	if !reused {
+		// the metadata goes first, so that a verified blob always comes with it
+		for _, p := range []string{metadataPath(row.Path), row.Path} {
+			if err := copyBlobFile(ctx, src, dst, p, path.Join(opts.PathPrefix, p)); err != nil {
+				if p != row.Path && errors.Is(err, os.ErrNotExist) {
+					continue // the artifact has no metadata
+				}
+				return false, err
+			}
+		}
+
+		if err := verifyMigratedArtifact(ctx, dst, migrated); err != nil {
+			return false, fmt.Errorf("error verifying copy: %w", err)
+		}
+	}
+
+	tx := ctx.DB().Model(&models.Artifact{}).
+		Where("id = ? AND connection_id = ?", row.ID, row.ConnectionID).
+		UpdateColumns(map[string]any{"connection_id": opts.DestinationConnectionID, "path": migrated.Path})
+	if tx.Error != nil {
+		return false, fmt.Errorf("error updating artifact row: %w", tx.Error)
+	} else if tx.RowsAffected == 0 {
+		return false, errors.New("artifact row was changed during the migration")
+	}
+
+	return reused, nil
+}
+
+// verifyMigratedArtifact checks the size and checksum of the artifact on the destination against its row.
+func verifyMigratedArtifact(ctx context.Context, fs artifactFS.FilesystemRW, artifact models.Artifact) error {
+	info, err := fs.Stat(artifact.Path)
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != artifact.Size {
+		return fmt.Errorf("size mismatch: expected %d bytes, got %d", artifact.Size, info.Size())
+	}
+
+	checksum, err := contentChecksum(ctx, fs, &artifact)
+	if err != nil {
+		return err
+	}
+
+	if checksum != artifact.Checksum {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, artifact.Checksum, checksum)
+	}
+
+	return nil
+}
+
+// copyBlobFile copies a file as stored, replacing any partial copy on the destination.
+func copyBlobFile(ctx context.Context, src, dst artifactFS.FilesystemRW, srcPath, dstPath string) error {
+	reader, err := src.Read(ctx, srcPath)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", srcPath, err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	opts := artifactFS.GetWriteOptions(ctx)
+	opts.Mode = artifactFS.WriteOverwrite
+	opts.IfMatch = ""
+
+	if _, err := dst.Write(artifactFS.WithWriteOptions(ctx, opts), dstPath, reader); err != nil {
+		return fmt.Errorf("error writing %s: %w", dstPath, err)
+	}
+
+	return nil
+}
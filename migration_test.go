@@ -0,0 +1,151 @@
+package artifacts
+
+import (
+	"errors"
+	"testing"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+)
+
+func TestMigrateArtifacts(t *testing.T) {
+	ctx := newTestContext(t)
+	sourceID, destinationID := uuid.New(), uuid.New()
+
+	save := func(fs artifactFS.FilesystemRW, path string) *models.Artifact {
+		artifact := &models.Artifact{ConnectionID: sourceID}
+		if err := SaveArtifact(ctx, fs, artifact, Artifact{Path: path, Content: streamed(path), ContentLength: -1}); err != nil {
+			t.Fatal(err)
+		}
+		return artifact
+	}
+
+	reload := func(artifact *models.Artifact) models.Artifact {
+		var row models.Artifact
+		if err := ctx.DB().Where("id = ?", artifact.ID).First(&row).Error; err != nil {
+			t.Fatal(err)
+		}
+		return row
+	}
+
+	t.Run("moves the blobs and rows", func(t *testing.T) {
+		src, dst := artifactFS.NewLocalFS(t.TempDir()), artifactFS.NewLocalFS(t.TempDir())
+		artifact := save(src, "a.txt")
+
+		dryRun, err := MigrateArtifacts(ctx, sourceID, src, dst, MigrationOptions{DestinationConnectionID: destinationID, DryRun: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dryRun.Migrated != 1 || reload(artifact).ConnectionID != sourceID {
+			t.Fatalf("expected a dry run to report 1 artifact and leave its row, got %+v", dryRun)
+		}
+
+		result, err := MigrateArtifacts(ctx, sourceID, src, dst, MigrationOptions{DestinationConnectionID: destinationID, PathPrefix: "migrated", DeleteSource: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Migrated != 1 || result.Bytes != artifact.Size || len(result.Failed)+len(result.SourceCleanupFailed) > 0 {
+			t.Fatalf("unexpected result %+v", result)
+		}
+
+		row := reload(artifact)
+		if row.ConnectionID != destinationID || row.Path != "migrated/a.txt" {
+			t.Errorf("expected the row to point at migrated/a.txt on the destination, got %s on %s", row.Path, row.ConnectionID)
+		}
+		if content := readContent(t, ctx, dst, &row); content != "a.txt" {
+			t.Errorf("expected the migrated content, got %q", content)
+		}
+		if _, err := src.Stat("a.txt"); err == nil {
+			t.Error("expected the source blob to be deleted")
+		}
+	})
+
+	t.Run("resumes an interrupted migration", func(t *testing.T) {
+		src, dst := artifactFS.NewLocalFS(t.TempDir()), artifactFS.NewLocalFS(t.TempDir())
+		artifact := save(src, "b.txt")
+		if err := copyBlobFile(ctx, src, dst, "b.txt", "b.txt"); err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := MigrateArtifacts(ctx, sourceID, src, dst, MigrationOptions{DestinationConnectionID: destinationID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Migrated != 1 || result.Reused != 1 {
+			t.Errorf("expected the copy of the earlier run to be reused, got %+v", result)
+		}
+		if reload(artifact).ConnectionID != destinationID {
+			t.Error("expected the row to point at the destination")
+		}
+	})
+
+	t.Run("keeps the row of a failed artifact", func(t *testing.T) {
+		src, dst := artifactFS.NewLocalFS(t.TempDir()), artifactFS.NewLocalFS(t.TempDir())
+		artifact := save(src, "c.txt")
+		if err := src.Delete(ctx, "c.txt"); err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := MigrateArtifacts(ctx, sourceID, src, dst, MigrationOptions{DestinationConnectionID: destinationID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Migrated != 0 || len(result.Failed) != 1 || result.Failed[0].Artifact.ID != artifact.ID {
+			t.Errorf("expected the missing blob to fail, got %+v", result)
+		}
+		if reload(artifact).ConnectionID != sourceID {
+			t.Error("expected the row to still point at the source")
+		}
+		_ = ctx.DB().Delete(&models.Artifact{}, "id = ?", artifact.ID)
+	})
+
+	t.Run("reports a source that could not be deleted", func(t *testing.T) {
+		local, dst := artifactFS.NewLocalFS(t.TempDir()), artifactFS.NewLocalFS(t.TempDir())
+		artifact := save(local, "d.txt")
+
+		result, err := MigrateArtifacts(ctx, sourceID, undeletableFS{local}, dst, MigrationOptions{DestinationConnectionID: destinationID, DeleteSource: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Migrated != 1 || len(result.Failed) != 0 {
+			t.Errorf("expected the artifact to be migrated, got %+v", result)
+		}
+		if len(result.SourceCleanupFailed) != 1 || !errors.Is(result.SourceCleanupFailed[0], errDeleteFailed) {
+			t.Errorf("expected the failed deletion of the source to be reported, got %+v", result.SourceCleanupFailed)
+		}
+		if reload(artifact).ConnectionID != destinationID {
+			t.Error("expected the row to point at the destination")
+		}
+	})
+
+	t.Run("keeps a blob shared with an artifact still on the source", func(t *testing.T) {
+		src, dst := artifactFS.NewLocalFS(t.TempDir()), artifactFS.NewLocalFS(t.TempDir())
+		var shared []*models.Artifact
+		for range 2 {
+			artifact := &models.Artifact{ConnectionID: sourceID}
+			err := SaveArtifact(ctx, src, artifact, Artifact{Path: "e.txt", PathTemplate: ContentAddressedPathTemplate, Content: streamed("e"), ContentLength: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			shared = append(shared, artifact)
+		}
+
+		// the second artifact fails to verify, so it stays on the source
+		if err := ctx.DB().Model(&models.Artifact{}).Where("id = ?", shared[1].ID).UpdateColumn("size", 999).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := MigrateArtifacts(ctx, sourceID, src, dst, MigrationOptions{DestinationConnectionID: destinationID, DeleteSource: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Migrated != 1 || len(result.Failed) != 1 {
+			t.Errorf("expected one artifact to migrate and the other to fail, got %+v", result)
+		}
+		if _, err := src.Stat(shared[1].Path); err != nil {
+			t.Errorf("expected the blob of the artifact left on the source to be kept, got %v", err)
+		}
+		_ = ctx.DB().Delete(&models.Artifact{}, "id = ?", shared[1].ID)
+	})
+}
@@ -0,0 +1,130 @@
+package artifacts
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// extensionContentTypes maps file extensions to the content type of files that magic bytes cannot tell apart.
+// It is consulted when the content is only detected as a generic type (see genericContentTypes),
+// and can be extended or overridden with RegisterExtensionContentType.
+var extensionContentTypes = map[string]string{
+	".log":    "text/x-log",
+	".yaml":   "application/yaml",
+	".yml":    "application/yaml",
+	".har":    "application/har+json",
+	".md":     "text/markdown",
+	".csv":    "text/csv",
+	".tsv":    "text/tab-separated-values",
+	".toml":   "application/toml",
+	".ini":    "text/x-ini",
+	".ndjson": "application/x-ndjson",
+	".jsonl":  "application/x-ndjson",
+	".sql":    "application/sql",
+	".diff":   "text/x-diff",
+	".patch":  "text/x-diff",
+	".tf":     "text/x-terraform",
+}
+
+var extensionContentTypesMu sync.RWMutex
+
+// RegisterExtensionContentType sets the content type of files with the extension, e.g. ".log",
+// when their content is only detected as a generic type. It is safe to call while artifacts are saved.
+func RegisterExtensionContentType(extension, contentType string) {
+	extensionContentTypesMu.Lock()
+	defer extensionContentTypesMu.Unlock()
+	extensionContentTypes[strings.ToLower(extension)] = contentType
+}
+
+// ExtensionContentType returns the content type registered for the extension.
+func ExtensionContentType(extension string) (string, bool) {
+	extensionContentTypesMu.RLock()
+	defer extensionContentTypesMu.RUnlock()
+	contentType, ok := extensionContentTypes[strings.ToLower(extension)]
+	return contentType, ok
+}
+
+// genericContentTypes are the detected types that the path extension may refine.
+var genericContentTypes = []string{"text/plain", "application/octet-stream", "application/json"}
+
+// DetectContentType detects the content type from the magic bytes in header,
+// refined by the extension of path when the content alone only yields a generic type.
+func DetectContentType(filename string, header []byte) string {
+	detected := mimetype.Detect(header)
+
+	if extensionType, ok := ExtensionContentType(filepath.Ext(filename)); ok {
+		for _, generic := range genericContentTypes {
+			if detected.Is(generic) {
+				return extensionType
+			}
+		}
+	}
+
+	return detected.String()
+}
+
+// matchContentType reports whether the media type of contentType matches any of the patterns.
+// Patterns are matched with path.Match, so "text/*" matches every text type.
+func matchContentType(patterns []string, contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, mediaType); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExecutableContentTypes are the content types of executables, installers and scripts,
+// for use in ContentTypePolicy.Deny.
+var ExecutableContentTypes = []string{
+	"application/x-elf",
+	"application/x-executable",
+	"application/x-sharedlib",
+	"application/x-mach-binary",
+	"application/vnd.microsoft.portable-executable",
+	"application/x-msdownload",
+	"application/x-ms-installer",
+	"application/x-windows-installer",
+	"application/x-java-applet",
+	"application/x-sh",
+	"application/x-shellscript",
+	"text/x-sh",
+	"text/x-shellscript",
+}
+
+// ContentTypePolicy restricts the content types SaveArtifact accepts.
+// Patterns are matched with path.Match, so "image/*" matches every image type.
+type ContentTypePolicy struct {
+	// Allow lists the accepted content types. When empty, every type that is not denied is accepted.
+	Allow []string
+
+	// Deny lists the rejected content types. It takes precedence over Allow.
+	Deny []string
+}
+
+// ContentTypeNotAllowedError is returned when an artifact's content type is rejected by its ContentTypePolicy.
+type ContentTypeNotAllowedError struct {
+	Path        string
+	ContentType string
+}
+
+func (e *ContentTypeNotAllowedError) Error() string {
+	return fmt.Sprintf("content type %s of artifact(%s) is not allowed", e.ContentType, e.Path)
+}
+
+// Allows reports whether content of the given type is accepted.
+func (t ContentTypePolicy) Allows(contentType string) bool {
+	if matchContentType(t.Deny, contentType) {
+		return false
+	}
+
+	return len(t.Allow) == 0 || matchContentType(t.Allow, contentType)
+}
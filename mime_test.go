@@ -0,0 +1,45 @@
+package artifacts
+
+import "testing"
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		path     string
+		content  string
+		expected string
+	}{
+		{"output.log", "2024-01-01 started\n", "text/x-log"},
+		{"values.yaml", "name: test\n", "application/yaml"},
+		{"trace.har", `{"log": {"version": "1.2"}}`, "application/har+json"},
+		{"report.json", `{"name": "test"}`, "application/json"},
+		{"report.txt", "plain text", "text/plain; charset=utf-8"},
+		{"archive.log", "\x1f\x8b\x08\x00\x00\x00\x00\x00", "application/gzip"},
+		{"pipeline.GROOVY", "pipeline {}", "text/x-groovy"},
+	}
+
+	RegisterExtensionContentType(".groovy", "text/x-groovy")
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := DetectContentType(tt.path, []byte(tt.content)); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestContentTypePolicy(t *testing.T) {
+	policy := ContentTypePolicy{Allow: []string{"text/*", "application/json"}, Deny: ExecutableContentTypes}
+
+	for contentType, allowed := range map[string]bool{
+		"text/plain; charset=utf-8": true,
+		"application/json":          true,
+		"text/x-shellscript":        false,
+		"application/x-executable":  false,
+		"image/png":                 false,
+	} {
+		if policy.Allows(contentType) != allowed {
+			t.Errorf("expected %s to be allowed=%v", contentType, allowed)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package artifacts
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+)
+
+const (
+	// DateShardedPathTemplate places artifacts in a directory per day.
+	DateShardedPathTemplate = "{{.date}}/{{.uuid}}-{{.filename}}"
+
+	// ContentAddressedPathTemplate places artifacts by the SHA-256 of their content,
+	// sharded by its first bytes so that writes are spread evenly across prefixes.
+	// Saving content that is already stored on the connection records another artifact of the stored blob.
+	ContentAddressedPathTemplate = "{{slice .sha256 0 2}}/{{slice .sha256 2 4}}/{{.sha256}}{{.ext}}"
+)
+
+// pathTemplateVars returns the variables available to Artifact.PathTemplate:
+//
+//   - date: the current UTC date as 2006/01/02
+//   - time: the current UTC time as 150405
+//   - timestamp: the current unix time
+//   - uuid: a random UUID
+//   - filename, name, ext: the base name of Artifact.Path, without and only its extension
+//   - check_id, playbook_run_action_id, connection_id: the IDs of the artifact row, empty when unset
+//   - sha256: the hex encoded SHA-256 of the content as given, before any redaction
+func pathTemplateVars(artifact *models.Artifact, filename, checksum string) map[string]any {
+	now := time.Now().UTC()
+	ext := path.Ext(filename)
+
+	return map[string]any{
+		"date":                   now.Format("2006/01/02"),
+		"time":                   now.Format("150405"),
+		"timestamp":              now.Unix(),
+		"uuid":                   uuid.New().String(),
+		"filename":               filename,
+		"name":                   strings.TrimSuffix(filename, ext),
+		"ext":                    ext,
+		"check_id":               uuidString(artifact.CheckID),
+		"playbook_run_action_id": uuidString(artifact.PlaybookRunActionID),
+		"connection_id":          uuidString(&artifact.ConnectionID),
+		"sha256":                 checksum,
+	}
+}
+
+func uuidString(id *uuid.UUID) string {
+	if id == nil || *id == uuid.Nil {
+		return ""
+	}
+	return id.String()
+}
+
+// renderArtifactPath evaluates the artifact's path template and returns the first free path it resolves to.
+// Templates that use the checksum of the content spool the content to a temporary file first, within its limits.
+// When such a template resolves to the path of an artifact of the connection that is still stored,
+// the content is identical and that artifact is returned instead. The lookup holds queries.
+func renderArtifactPath(ctx context.Context, fs artifactFS.FilesystemRW, artifact *models.Artifact, data *Artifact, limits []sizeLimit, queries sync.Locker) (string, *models.Artifact, error) {
+	tpl, err := template.New("path").Option("missingkey=error").Parse(data.PathTemplate)
+	if err != nil {
+		return "", nil, fmt.Errorf("error parsing path template %q: %w", data.PathTemplate, err)
+	}
+
+	var checksum string
+	contentAddressed := usesField(tpl.Root, "sha256")
+	if contentAddressed {
+		if checksum, err = spoolContent(data, contentLimits(limits, *data)); err != nil {
+			return "", nil, fmt.Errorf("error spooling artifact(%s): %w", data.Path, err)
+		}
+	}
+
+	var rendered bytes.Buffer
+	if err := tpl.Execute(&rendered, pathTemplateVars(artifact, path.Base(data.Path), checksum)); err != nil {
+		return "", nil, fmt.Errorf("error rendering path template %q: %w", data.PathTemplate, err)
+	}
+
+	renderedPath := path.Clean(strings.TrimPrefix(rendered.String(), "/"))
+	if renderedPath == "." {
+		return "", nil, fmt.Errorf("path template %q rendered an empty path", data.PathTemplate)
+	}
+
+	if contentAddressed {
+		queries.Lock()
+		existing, err := storedArtifact(ctx, fs, artifact.ConnectionID, renderedPath)
+		queries.Unlock()
+		if err != nil || existing != nil {
+			return "", existing, err
+		}
+	}
+
+	uniquePath, err := artifactFS.UniquePath(fs, renderedPath)
+	return uniquePath, nil, err
+}
+
+// storedArtifact returns the artifact of the connection at path, if it exists and its blob is stored.
+func storedArtifact(ctx context.Context, fs artifactFS.FilesystemRW, connectionID uuid.UUID, blobPath string) (*models.Artifact, error) {
+	var existing models.Artifact
+	err := ctx.DB().Where("connection_id = ? AND path = ? AND deleted_at IS NULL", connectionID, blobPath).Limit(1).Find(&existing).Error
+	if err != nil {
+		return nil, fmt.Errorf("error looking up artifact(%s): %w", blobPath, err)
+	}
+	if existing.ID == uuid.Nil {
+		return nil, nil
+	}
+
+	if _, err := fs.Stat(blobPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error checking if %s exists: %w", blobPath, err)
+	}
+
+	return &existing, nil
+}
+
+// referencedBlobs returns which of the paths are the blob of a live artifact of the connection other than
+// the excluded ones. Artifacts of identical content-addressed content share a blob.
+func referencedBlobs(ctx context.Context, connectionID uuid.UUID, paths []string, excluded []uuid.UUID) (map[string]bool, error) {
+	db := ctx.DB().Model(&models.Artifact{}).Where("connection_id = ? AND path IN ? AND deleted_at IS NULL", connectionID, paths)
+	if len(excluded) > 0 {
+		db = db.Where("id NOT IN ?", excluded)
+	}
+
+	var referenced []string
+	if err := db.Distinct().Pluck("path", &referenced).Error; err != nil {
+		return nil, fmt.Errorf("error looking up artifacts sharing a blob: %w", err)
+	}
+
+	return lo.SliceToMap(referenced, func(p string) (string, bool) { return p, true }), nil
+}
+
+// usesField reports whether the template node refers to the field, e.g. .sha256.
+func usesField(node parse.Node, field string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		return slices.ContainsFunc(n.Nodes, func(child parse.Node) bool { return usesField(child, field) })
+	case *parse.ActionNode:
+		return usesField(n.Pipe, field)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		return slices.ContainsFunc(n.Cmds, func(cmd *parse.CommandNode) bool { return usesField(cmd, field) })
+	case *parse.CommandNode:
+		return slices.ContainsFunc(n.Args, func(arg parse.Node) bool { return usesField(arg, field) })
+	case *parse.FieldNode:
+		return len(n.Ident) > 0 && n.Ident[0] == field
+	case *parse.IfNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	case *parse.RangeNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	case *parse.WithNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	}
+
+	return false
+}
+
+// spoolContent copies the artifact's content to a temporary file, which replaces it, and returns its SHA-256.
+// The temporary file is removed when the content is closed. Spooling fails as soon as the content exceeds a limit.
+func spoolContent(data *Artifact, limits []sizeLimit) (string, error) {
+	file, err := os.CreateTemp("", "artifact-*")
+	if err != nil {
+		return "", err
+	}
+
+	spooled := &tempFile{File: file}
+	checksum := sha256.New()
+	var content io.Reader = data.Content
+	if len(limits) > 0 {
+		content = &limitReader{reader: data.Content, limits: limits}
+	}
+
+	size, err := io.Copy(io.MultiWriter(file, checksum), content)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = spooled.Close()
+		return "", err
+	}
+
+	_ = data.Content.Close()
+	data.Content = spooled
+	data.ContentLength = size
+	return hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// tempFile is a temporary file that is removed when closed.
+type tempFile struct {
+	*os.File
+}
+
+func (t *tempFile) Close() error {
+	return errors.Join(t.File.Close(), os.Remove(t.Name()))
+}
@@ -0,0 +1,92 @@
+package artifacts
+
+import (
+	"testing"
+	"text/template"
+	"time"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+)
+
+func TestUsesField(t *testing.T) {
+	for text, expected := range map[string]bool{
+		ContentAddressedPathTemplate:              true,
+		DateShardedPathTemplate:                   false,
+		"checksums/{{.name}}.sha256":              false,
+		"{{if .check_id}}{{.sha256}}{{end}}":      true,
+		"{{with $sum := .sha256}}{{$sum}}{{end}}": true,
+	} {
+		tpl, err := template.New("path").Parse(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usesField(tpl.Root, "sha256") != expected {
+			t.Errorf("expected %q to use sha256=%v", text, expected)
+		}
+	}
+}
+
+func TestContentAddressedDeduplication(t *testing.T) {
+	ctx := newTestContext(t)
+	fs := artifactFS.NewLocalFS(t.TempDir())
+	connectionID := uuid.New()
+
+	save := func(content string, checkID uuid.UUID) *models.Artifact {
+		artifact := &models.Artifact{ConnectionID: connectionID, CheckID: &checkID}
+		err := SaveArtifact(ctx, fs, artifact, Artifact{
+			Path:          "report.txt",
+			PathTemplate:  ContentAddressedPathTemplate,
+			Content:       streamed(content),
+			ContentLength: -1,
+			Labels:        map[string]string{"check": checkID.String()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return artifact
+	}
+
+	first := save("same content", uuid.New())
+	checkID := uuid.New()
+	second := save("same content", checkID)
+	if second.ID == first.ID || second.Path != first.Path {
+		t.Errorf("expected an artifact of its own at %s, got %s(%s)", first.Path, second.ID, second.Path)
+	}
+	if *second.CheckID != checkID || second.Checksum != first.Checksum || second.Size != first.Size {
+		t.Errorf("expected the check of the caller and the blob of the stored artifact, got %+v", second)
+	}
+
+	labeled, err := ListArtifacts(ctx, ArtifactQuery{ConnectionID: connectionID, Labels: map[string]string{"check": checkID.String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labeled) != 1 || labeled[0].ID != second.ID {
+		t.Errorf("expected the labels of the deduplicated artifact to be recorded, got %+v", labeled)
+	}
+
+	other := save("other content", uuid.New())
+	if other.Path == first.Path {
+		t.Errorf("expected other content to be stored at its own path, got %s", other.Path)
+	}
+
+	var count int64
+	if err := ctx.DB().Model(&models.Artifact{}).Where("connection_id = ?", connectionID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 artifact rows, got %d", count)
+	}
+
+	// the shared blob is kept while an artifact still points at it
+	if err := ctx.DB().Model(&models.Artifact{}).Where("id = ?", first.ID).UpdateColumn("expires_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if result, err := ApplyRetention(ctx, connectionID, fs, RetentionPolicy{}); err != nil || result.Deleted != 1 {
+		t.Fatalf("expected the expired artifact to be removed, got %+v: %v", result, err)
+	}
+	if content := readContent(t, ctx, fs, second); content != "same content" {
+		t.Errorf("expected the shared blob to be kept, got %q", content)
+	}
+}
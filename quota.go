@@ -0,0 +1,165 @@
+package artifacts
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+)
+
+// Quota limits the combined size of the artifacts stored in the artifacts table.
+// Limits that are zero are not enforced.
+//
+// Usage and quotas count the stored size of the artifacts, as recorded in the artifacts table,
+// that is after compression and client-side encryption.
+// Quotas are checked before the write, using the content length if the content is stored as is,
+// enforced on the stored bytes while streaming and checked against the stored size once written.
+// Concurrent saves are not serialized, so they can together exceed a quota by the size of the in-flight artifacts.
+type Quota struct {
+	// ConnectionBytes limits the total size of the artifacts stored on the artifact's connection.
+	ConnectionBytes int64
+
+	// OwnerBytes limits the total size of the artifacts of the artifact's check, or else its playbook run action.
+	OwnerBytes int64
+}
+
+// ArtifactTooLargeError is returned when an artifact exceeds Artifact.MaxSize.
+type ArtifactTooLargeError struct {
+	Path  string
+	Limit int64
+}
+
+func (e *ArtifactTooLargeError) Error() string {
+	return fmt.Sprintf("artifact(%s) exceeds the maximum size of %d bytes", e.Path, e.Limit)
+}
+
+// QuotaExceededError is returned when saving an artifact would exceed a Quota.
+type QuotaExceededError struct {
+	// Scope is the quota that was exceeded: connection, check or playbook_run_action
+	Scope string
+	ID    uuid.UUID
+	Limit int64
+	Used  int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("artifact quota of %s(%s) exceeded: %d of %d bytes used", e.Scope, e.ID, e.Used, e.Limit)
+}
+
+// sizeLimit is the number of bytes an artifact may have before it fails with err.
+type sizeLimit struct {
+	limit int64
+	err   error
+
+	// stored limits the stored size of the artifact rather than the size of its content
+	stored bool
+}
+
+// storedAsIs reports whether the artifact is stored with the size of its content,
+// so that limits on the stored size can be enforced on the content.
+func storedAsIs(data Artifact) bool {
+	return data.Compression == "" && data.Redaction == nil && data.KeyProvider == nil
+}
+
+// contentLimits returns the limits that can be enforced on the content of the artifact.
+func contentLimits(limits []sizeLimit, data Artifact) []sizeLimit {
+	return lo.Filter(limits, func(l sizeLimit, _ int) bool { return !l.stored || storedAsIs(data) })
+}
+
+// storedLimits returns the limits on the stored size of the artifact.
+func storedLimits(limits []sizeLimit) []sizeLimit {
+	return lo.Filter(limits, func(l sizeLimit, _ int) bool { return l.stored })
+}
+
+// sizeLimits returns the limits that apply to the artifact, failing fast when one is already exceeded.
+// It is called before the content is read, so that no content is spooled or stored past a limit.
+func sizeLimits(ctx context.Context, artifact *models.Artifact, data Artifact) ([]sizeLimit, error) {
+	var limits []sizeLimit
+	if data.MaxSize > 0 {
+		limits = append(limits, sizeLimit{limit: data.MaxSize, err: &ArtifactTooLargeError{Path: data.Path, Limit: data.MaxSize}})
+	}
+
+	if data.Quota != nil {
+		type scope struct {
+			name  string
+			id    *uuid.UUID
+			limit int64
+		}
+
+		scopes := []scope{{name: "connection", id: &artifact.ConnectionID, limit: data.Quota.ConnectionBytes}}
+		if artifact.CheckID != nil {
+			scopes = append(scopes, scope{name: "check", id: artifact.CheckID, limit: data.Quota.OwnerBytes})
+		} else if artifact.PlaybookRunActionID != nil {
+			scopes = append(scopes, scope{name: "playbook_run_action", id: artifact.PlaybookRunActionID, limit: data.Quota.OwnerBytes})
+		}
+
+		for _, s := range scopes {
+			if s.limit <= 0 || *s.id == uuid.Nil {
+				continue
+			}
+
+			var used int64
+			err := ctx.DB().Model(&models.Artifact{}).
+				Select("COALESCE(SUM(size), 0)").
+				Where(fmt.Sprintf("%s_id = ? AND deleted_at IS NULL", s.name), *s.id).
+				Scan(&used).Error
+			if err != nil {
+				return nil, fmt.Errorf("error computing artifact usage of %s(%s): %w", s.name, *s.id, err)
+			}
+
+			limits = append(limits, sizeLimit{
+				limit:  s.limit - used,
+				err:    &QuotaExceededError{Scope: s.name, ID: *s.id, Limit: s.limit, Used: used},
+				stored: true,
+			})
+		}
+	}
+
+	if data.ContentLength >= 0 {
+		for _, l := range contentLimits(limits, data) {
+			if data.ContentLength > l.limit {
+				return nil, l.err
+			}
+		}
+	}
+	for _, l := range limits {
+		if l.limit < 0 {
+			return nil, l.err
+		}
+	}
+
+	return limits, nil
+}
+
+// limitReader fails with the error of the first limit the content grows beyond.
+type limitReader struct {
+	reader io.Reader
+	limits []sizeLimit
+	read   int64
+}
+
+func (t *limitReader) Read(p []byte) (int, error) {
+	n, err := t.reader.Read(p)
+	t.read += int64(n)
+	for _, l := range t.limits {
+		if t.read > l.limit {
+			return 0, l.err
+		}
+	}
+
+	return n, err
+}
+
+// checkStoredSize fails with the error of the first limit the stored artifact exceeds.
+func checkStoredSize(limits []sizeLimit, size int64) error {
+	for _, l := range storedLimits(limits) {
+		if size > l.limit {
+			return l.err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package artifacts
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+)
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+func (t *countingReader) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	t.read += n
+	return n, err
+}
+
+func (t *countingReader) Close() error { return nil }
+
+func TestSaveArtifactQuota(t *testing.T) {
+	ctx := newTestContext(t)
+	fs := artifactFS.NewLocalFS(t.TempDir())
+	connectionID := uuid.New()
+	quota := &Quota{ConnectionBytes: 1024}
+
+	t.Run("stored size of compressed content", func(t *testing.T) {
+		err := SaveArtifact(ctx, fs, &models.Artifact{ConnectionID: connectionID}, Artifact{
+			Path:          "compressed.txt",
+			Content:       streamed(strings.Repeat("a", 64*1024)),
+			ContentLength: -1,
+			Compression:   CompressionGzip,
+			Quota:         quota,
+		})
+		if err != nil {
+			t.Fatalf("expected the compressed artifact to fit the quota, got %v", err)
+		}
+	})
+
+	t.Run("checked before spooling", func(t *testing.T) {
+		content := &countingReader{Reader: strings.NewReader(strings.Repeat("b", 1024*1024))}
+		err := SaveArtifact(ctx, fs, &models.Artifact{ConnectionID: connectionID}, Artifact{
+			Path:          "large.txt",
+			PathTemplate:  ContentAddressedPathTemplate,
+			Content:       content,
+			ContentLength: -1,
+			Quota:         quota,
+		})
+
+		var exceeded *QuotaExceededError
+		if !errors.As(err, &exceeded) {
+			t.Fatalf("expected QuotaExceededError, got %v", err)
+		}
+		if content.read >= 1024*1024 {
+			t.Errorf("expected spooling to stop at the quota, read %d bytes", content.read)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+)
+
+const defaultReconcileMinAge = 5 * time.Minute
+
+// ReconcileOptions controls what Reconcile checks and which fixes it applies.
+type ReconcileOptions struct {
+	// Root is the directory walked on the filesystem. Defaults to the filesystem root.
+	// Only the artifact rows beneath it are reconciled.
+	Root string
+
+	// VerifyChecksum re-reads every blob to compare its checksum with the artifact row.
+	VerifyChecksum bool
+
+	// DeleteOrphans deletes blobs that have no artifact row.
+	DeleteOrphans bool
+
+	// MinAge is how old a blob without an artifact row must be to be an orphan: a newer one may be
+	// an artifact being saved, whose row is not committed yet. Defaults to 5 minutes, a negative MinAge
+	// makes every blob without a row an orphan.
+	MinAge time.Duration
+
+	// SoftDeleteDangling marks artifact rows whose blob is missing as deleted.
+	SoftDeleteDangling bool
+
+	// DryRun reports what would be fixed without changing the filesystem or the database.
+	DryRun bool
+}
+
+// ReconcileMismatch is an artifact whose stored blob differs from its row.
+type ReconcileMismatch struct {
+	Artifact models.Artifact
+
+	// Size of the stored blob
+	Size int64
+
+	// Checksum of the stored blob. Only set when ReconcileOptions.VerifyChecksum is enabled.
+	Checksum string
+}
+
+type ReconcileReport struct {
+	// Orphans are paths of blobs that have no artifact row, and are older than ReconcileOptions.MinAge.
+	Orphans []string
+
+	// Dangling are artifact rows whose blob is missing.
+	// They are not reported when the listing was truncated.
+	Dangling []models.Artifact
+
+	// Truncated is set when the filesystem listed only part of the blobs, see artifactFS.ListItemLimiter.
+	// A row whose blob was not listed may still have one, so dangling rows are not reported.
+	Truncated bool
+
+	// Mismatches are artifacts whose blob size or checksum differs from the row.
+	Mismatches []ReconcileMismatch
+
+	// DeletedOrphans is the number of orphaned blobs deleted.
+	DeletedOrphans int
+
+	// SoftDeleted is the number of dangling rows marked as deleted.
+	SoftDeleted int
+}
+
+// Reconcile compares the blobs on a connection's filesystem with the artifact rows
+// recorded for that connection and reports orphans, dangling rows and mismatches.
+//
+// Orphans are only deleted and dangling rows only soft-deleted when requested in opts,
+// and never in dry-run mode.
+func Reconcile(ctx context.Context, connectionID uuid.UUID, fs artifactFS.FilesystemRW, opts ReconcileOptions) (*ReconcileReport, error) {
+	root := path.Clean(opts.Root)
+	if opts.MinAge == 0 {
+		opts.MinAge = defaultReconcileMinAge
+	}
+	orphaned := func(info os.FileInfo) bool {
+		return time.Since(info.ModTime()) >= opts.MinAge
+	}
+
+	db := ctx.DB().Where("connection_id = ? AND deleted_at IS NULL", connectionID)
+	if root != "." {
+		db = db.Where(`path LIKE ? ESCAPE '\'`, escapeLike(root)+"/%")
+	}
+
+	var rows []models.Artifact
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("error listing artifacts for connection(%s): %w", connectionID, err)
+	}
+
+	artifactsByPath := make(map[string]models.Artifact, len(rows))
+	for _, row := range rows {
+		artifactsByPath[path.Clean(row.Path)] = row
+	}
+
+	var report ReconcileReport
+	seen := make(map[string]struct{}, len(rows))
+	err := artifactFS.Walk(fs, opts.Root, func(blobPath string, info os.FileInfo) error {
+		blobPath = path.Clean(blobPath)
+		if IsMetadataPath(blobPath) {
+			// a sidecar is an orphan together with its artifact
+			if _, ok := artifactsByPath[strings.TrimSuffix(blobPath, MetadataSuffix)]; !ok && orphaned(info) {
+				report.Orphans = append(report.Orphans, blobPath)
+			}
+			return nil
+		}
+
+		artifact, ok := artifactsByPath[blobPath]
+		if !ok {
+			if orphaned(info) {
+				report.Orphans = append(report.Orphans, blobPath)
+			}
+			return nil
+		}
+		seen[blobPath] = struct{}{}
+
+		mismatch := ReconcileMismatch{Artifact: artifact, Size: info.Size()}
+		if opts.VerifyChecksum {
+			checksum, err := contentChecksum(ctx, fs, &artifact)
+			if err != nil {
+				return fmt.Errorf("error computing checksum of artifact(%s): %w", artifact.Path, err)
+			}
+			mismatch.Checksum = checksum
+		}
+
+		if mismatch.Size != artifact.Size || (opts.VerifyChecksum && mismatch.Checksum != artifact.Checksum) {
+			report.Mismatches = append(report.Mismatches, mismatch)
+		}
+
+		return nil
+	})
+	if errors.Is(err, artifactFS.ErrListTruncated) {
+		report.Truncated = true
+	} else if err != nil {
+		return nil, fmt.Errorf("error walking filesystem: %w", err)
+	}
+
+	for blobPath, artifact := range artifactsByPath {
+		if _, ok := seen[blobPath]; !ok && !report.Truncated {
+			report.Dangling = append(report.Dangling, artifact)
+		}
+	}
+
+	if opts.DryRun {
+		return &report, nil
+	}
+
+	var errs []error
+	if opts.DeleteOrphans {
+		for _, orphan := range report.Orphans {
+			if err := fs.Delete(ctx, orphan); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, fmt.Errorf("error deleting orphan(%s): %w", orphan, err))
+				continue
+			}
+			report.DeletedOrphans++
+		}
+	}
+
+	if opts.SoftDeleteDangling && len(report.Dangling) > 0 {
+		ids := lo.Map(report.Dangling, func(a models.Artifact, _ int) uuid.UUID { return a.ID })
+		tx := ctx.DB().Model(&models.Artifact{}).Where("id IN ?", ids).UpdateColumn("deleted_at", models.Now())
+		if tx.Error != nil {
+			errs = append(errs, fmt.Errorf("error soft deleting dangling artifacts: %w", tx.Error))
+		} else {
+			report.SoftDeleted = int(tx.RowsAffected)
+		}
+	}
+
+	return &report, errors.Join(errs...)
+}
+
+// contentChecksum computes the checksum of the artifact's content as it was passed to SaveArtifact.
+func contentChecksum(ctx context.Context, fs artifactFS.FilesystemRW, artifact *models.Artifact) (string, error) {
+	reader, err := ReadArtifact(ctx, fs, artifact)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = reader.Close() }()
+
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, reader); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
@@ -0,0 +1,124 @@
+package artifacts
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+)
+
+// truncatedFS reports every listing as cut short.
+type truncatedFS struct {
+	artifactFS.FilesystemRW
+}
+
+func (t truncatedFS) ReadDirTruncated(name string) ([]artifactFS.FileInfo, bool, error) {
+	entries, err := t.ReadDir(name)
+	return entries, true, err
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := newTestContext(t)
+	dir := t.TempDir()
+	fs := artifactFS.NewLocalFS(dir)
+	connectionID := uuid.New()
+
+	save := func(path string) *models.Artifact {
+		artifact := &models.Artifact{ConnectionID: connectionID}
+		if err := SaveArtifact(ctx, fs, artifact, Artifact{Path: path, Content: streamed(path), ContentLength: -1}); err != nil {
+			t.Fatal(err)
+		}
+		return artifact
+	}
+
+	save("logs/a.txt")
+	missing := save("logs/b.txt")
+	save("logs-archive/c.txt")
+	save("reports/d.txt")
+	if err := fs.Delete(ctx, missing.Path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Write(ctx, "logs/orphan.txt", streamed("orphan")); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "logs/orphan.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("only rows beneath the root", func(t *testing.T) {
+		report, err := Reconcile(ctx, connectionID, fs, ReconcileOptions{Root: "logs", DryRun: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(report.Dangling) != 1 || report.Dangling[0].ID != missing.ID {
+			t.Errorf("expected only %s to be dangling, got %+v", missing.Path, report.Dangling)
+		}
+		if !slices.Equal(report.Orphans, []string{"logs/orphan.txt"}) {
+			t.Errorf("expected logs/orphan.txt to be an orphan, got %v", report.Orphans)
+		}
+	})
+
+	t.Run("truncated listing", func(t *testing.T) {
+		report, err := Reconcile(ctx, connectionID, truncatedFS{fs}, ReconcileOptions{Root: "logs", SoftDeleteDangling: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !report.Truncated {
+			t.Error("expected the report to be truncated")
+		}
+		if len(report.Dangling) != 0 || report.SoftDeleted != 0 {
+			t.Errorf("expected no dangling rows, got %+v", report.Dangling)
+		}
+	})
+
+	t.Run("soft deletes dangling rows", func(t *testing.T) {
+		report, err := Reconcile(ctx, connectionID, fs, ReconcileOptions{SoftDeleteDangling: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.SoftDeleted != 1 {
+			t.Errorf("expected 1 row to be soft deleted, got %d", report.SoftDeleted)
+		}
+
+		var remaining int64
+		if err := ctx.DB().Model(&models.Artifact{}).Where("connection_id = ? AND deleted_at IS NULL", connectionID).Count(&remaining).Error; err != nil {
+			t.Fatal(err)
+		}
+		if remaining != 3 {
+			t.Errorf("expected 3 artifacts to remain, got %d", remaining)
+		}
+	})
+
+	t.Run("keeps recent blobs without a row", func(t *testing.T) {
+		if _, err := fs.Write(ctx, "logs/saving.txt", streamed("saving")); err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := Reconcile(ctx, connectionID, fs, ReconcileOptions{Root: "logs", DeleteOrphans: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(report.Orphans, []string{"logs/orphan.txt"}) || report.DeletedOrphans != 1 {
+			t.Errorf("expected only logs/orphan.txt to be deleted, got %v", report.Orphans)
+		}
+		if _, err := fs.Stat("logs/saving.txt"); err != nil {
+			t.Errorf("expected the recent blob to be kept, got %v", err)
+		}
+
+		report, err = Reconcile(ctx, connectionID, fs, ReconcileOptions{Root: "logs", MinAge: -1, DryRun: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(report.Orphans, []string{"logs/saving.txt"}) {
+			t.Errorf("expected every blob without a row to be an orphan with a negative MinAge, got %v", report.Orphans)
+		}
+	})
+}
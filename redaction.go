@@ -0,0 +1,261 @@
+package artifacts
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/samber/lo"
+)
+
+type RedactionMode string
+
+const (
+	// RedactionMask replaces secrets with RedactionPolicy.Mask.
+	RedactionMask RedactionMode = "mask"
+
+	// RedactionReject fails the save when a secret is found.
+	RedactionReject RedactionMode = "reject"
+)
+
+const (
+	defaultRedactionMask = "[REDACTED]"
+
+	// privateKeyPattern is the name under which private key blocks are counted
+	privateKeyPattern = "private_key"
+
+	// maxRedactionLineSize is the longest line scanned as a whole; longer lines are scanned in segments.
+	maxRedactionLineSize = 256 * 1024
+
+	// maxRedactionSecretSize is the longest secret found across the boundary of two segments.
+	// The end of every segment is scanned again with the next one.
+	maxRedactionSecretSize = 4 * 1024
+)
+
+var (
+	privateKeyBegin  = regexp.MustCompile(`-----BEGIN[A-Z0-9 ]*PRIVATE KEY-----`)
+	privateKeyEnd    = regexp.MustCompile(`-----END[A-Z0-9 ]*PRIVATE KEY-----`)
+	privateKeyInline = regexp.MustCompile(`-----BEGIN[A-Z0-9 ]*PRIVATE KEY-----.*?-----END[A-Z0-9 ]*PRIVATE KEY-----`)
+)
+
+// SecretPattern is a named regular expression matching a secret.
+type SecretPattern struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// DefaultSecretPatterns are the secrets redacted when RedactionPolicy.Patterns is empty.
+// PEM encoded private keys are always redacted, whether on a single line or spanning multiple lines.
+var DefaultSecretPatterns = []SecretPattern{
+	{Name: "aws_access_key_id", Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{Name: "aws_secret_access_key", Pattern: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+=]{40}`)},
+	{Name: "jwt", Pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)},
+	{Name: "github_token", Pattern: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{Name: "slack_token", Pattern: regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{Name: "bearer_token", Pattern: regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/-]{16,}=*`)},
+	{Name: "password", Pattern: regexp.MustCompile(`(?i)\b(?:password|passwd|pwd)["']?\s*[:=]\s*["']?[^\s"',;]+`)},
+}
+
+// RedactableContentTypes are the content types scanned when RedactionPolicy.ContentTypes is empty.
+var RedactableContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/x-ndjson",
+	"application/xml",
+	"application/*+xml",
+	"application/yaml",
+	"application/x-yaml",
+	"application/toml",
+	"application/sql",
+	"application/javascript",
+}
+
+// RedactionPolicy configures the secret scanner applied to text artifacts before they are stored.
+type RedactionPolicy struct {
+	// Mode decides whether secrets are masked or the artifact is rejected. Defaults to RedactionMask.
+	Mode RedactionMode
+
+	// Patterns are the secrets to look for. Defaults to DefaultSecretPatterns;
+	// custom patterns can be added with append(DefaultSecretPatterns, ...).
+	Patterns []SecretPattern
+
+	// ContentTypes are the content types scanned. Defaults to RedactableContentTypes.
+	ContentTypes []string
+
+	// Mask replaces every secret. Defaults to [REDACTED].
+	Mask string
+}
+
+// SecretsFoundError is returned when an artifact saved with RedactionReject contains a secret.
+type SecretsFoundError struct {
+	Path    string
+	Pattern string
+}
+
+func (e *SecretsFoundError) Error() string {
+	return fmt.Sprintf("artifact(%s) contains a secret (%s)", e.Path, e.Pattern)
+}
+
+func (t RedactionPolicy) applies(contentType string) bool {
+	contentTypes := t.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = RedactableContentTypes
+	}
+
+	return matchContentType(contentTypes, contentType)
+}
+
+// redactReader scans the content line by line and masks, or rejects, the secrets it finds.
+type redactReader struct {
+	src      *bufio.Reader
+	path     string
+	mode     RedactionMode
+	patterns []SecretPattern
+	mask     []byte
+
+	// counts is the number of secrets found per pattern
+	counts       map[string]int
+	inPrivateKey bool
+
+	// carry is the end of the previous segment of a long line, scanned again with the next segment
+	carry []byte
+
+	buf []byte
+	err error
+}
+
+func newRedactReader(r io.Reader, path string, policy RedactionPolicy) *redactReader {
+	reader := &redactReader{
+		src:      bufio.NewReaderSize(r, maxRedactionLineSize),
+		path:     path,
+		mode:     policy.Mode,
+		patterns: policy.Patterns,
+		mask:     []byte(policy.Mask),
+		counts:   map[string]int{},
+	}
+
+	if reader.mode == "" {
+		reader.mode = RedactionMask
+	}
+
+	if len(reader.patterns) == 0 {
+		reader.patterns = DefaultSecretPatterns
+	}
+	reader.patterns = append([]SecretPattern{{Name: privateKeyPattern, Pattern: privateKeyInline}}, reader.patterns...)
+
+	if len(reader.mask) == 0 {
+		reader.mask = []byte(defaultRedactionMask)
+	}
+
+	return reader
+}
+
+func (t *redactReader) Read(p []byte) (int, error) {
+	for len(t.buf) == 0 {
+		if t.err != nil {
+			return 0, t.err
+		}
+
+		line, err := t.src.ReadSlice('\n')
+		segment := errors.Is(err, bufio.ErrBufferFull)
+		if err != nil && !segment {
+			t.err = err
+		}
+
+		line = append(t.carry, line...)
+		t.carry = nil
+		if segment {
+			// a secret may continue in the next segment, so the end of this one is held back
+			cut := t.segmentEnd(line)
+			t.carry = append([]byte{}, line[cut:]...)
+			line = line[:cut]
+		}
+
+		if len(line) > 0 {
+			if t.buf, err = t.redact(line); err != nil {
+				t.err = err
+				return 0, err
+			}
+		}
+	}
+
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+// segmentEnd returns how much of a segment of a long line can be redacted,
+// holding back its last maxRedactionSecretSize bytes and any secret that starts before them.
+func (t *redactReader) segmentEnd(segment []byte) int {
+	cut := max(len(segment)-maxRedactionSecretSize, 0)
+	end := cut
+
+	patterns := append([]*regexp.Regexp{privateKeyBegin, privateKeyEnd}, lo.Map(t.patterns, func(p SecretPattern, _ int) *regexp.Regexp { return p.Pattern })...)
+	for _, pattern := range patterns {
+		for _, match := range pattern.FindAllIndex(segment, -1) {
+			if match[0] < cut && match[1] > cut && match[1]-match[0] <= maxRedactionSecretSize {
+				end = min(end, match[0])
+			}
+		}
+	}
+
+	return end
+}
+
+func (t *redactReader) redact(line []byte) ([]byte, error) {
+	if t.inPrivateKey {
+		end := privateKeyEnd.FindIndex(line)
+		if end == nil {
+			return nil, nil
+		}
+
+		t.inPrivateKey = false
+		line = line[end[1]:]
+	}
+
+	// ReadSlice reuses its buffer, so the line is copied before it is returned
+	redacted := append([]byte{}, line...)
+	for _, secret := range t.patterns {
+		matches := secret.Pattern.FindAllIndex(redacted, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		if err := t.found(secret.Name, len(matches)); err != nil {
+			return nil, err
+		}
+		redacted = secret.Pattern.ReplaceAllLiteral(redacted, t.mask)
+	}
+
+	// a private key spanning multiple lines is dropped up to its end marker
+	if begin := privateKeyBegin.FindIndex(redacted); begin != nil {
+		if err := t.found(privateKeyPattern, 1); err != nil {
+			return nil, err
+		}
+
+		t.inPrivateKey = true
+		redacted = append(redacted[:begin[0]], t.mask...)
+	}
+
+	return redacted, nil
+}
+
+func (t *redactReader) found(pattern string, count int) error {
+	if t.mode == RedactionReject {
+		return &SecretsFoundError{Path: t.path, Pattern: pattern}
+	}
+
+	t.counts[pattern] += count
+	return nil
+}
+
+// Redactions returns the number of secrets masked per pattern.
+func (t *redactReader) Redactions() map[string]int {
+	if len(t.counts) == 0 {
+		return nil
+	}
+	return t.counts
+}
@@ -0,0 +1,148 @@
+package artifacts
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+)
+
+const defaultRetentionBatchSize = 100
+
+// RetentionPolicy decides which artifacts of a connection are removed.
+// Artifacts past their expires_at are always removed; every other limit is disabled when zero.
+type RetentionPolicy struct {
+	// MaxAge removes artifacts created longer ago than this.
+	MaxAge time.Duration
+
+	// MaxCountPerCheck keeps only the newest N artifacts of every check.
+	MaxCountPerCheck int
+
+	// MaxCountPerPlaybookRunAction keeps only the newest N artifacts of every playbook run action.
+	MaxCountPerPlaybookRunAction int
+
+	// MaxBytes keeps the newest artifacts of the connection whose combined size fits within this limit.
+	MaxBytes int64
+
+	// BatchSize is the number of artifacts deleted per batch. Defaults to 100.
+	BatchSize int
+}
+
+type RetentionResult struct {
+	// Deleted is the number of artifacts removed.
+	Deleted int
+
+	// BytesReclaimed is the combined size of the removed artifacts.
+	BytesReclaimed int64
+}
+
+// ApplyRetention deletes the blobs of all artifacts of the connection that fall outside the policy
+// and soft-deletes their rows, in batches.
+//
+// Rows are only soft-deleted once their blob is gone, so a failed blob deletion is retried on the next run.
+// A blob shared with an artifact that is kept, see ContentAddressedPathTemplate, is kept as well.
+func ApplyRetention(ctx context.Context, connectionID uuid.UUID, fs artifactFS.FilesystemRW, policy RetentionPolicy) (*RetentionResult, error) {
+	candidates, err := retentionCandidates(ctx, connectionID, policy)
+	if err != nil {
+		return nil, fmt.Errorf("error finding artifacts to remove: %w", err)
+	}
+
+	batchSize := policy.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultRetentionBatchSize
+	}
+
+	idsByPath := map[string][]uuid.UUID{}
+	for _, artifact := range candidates {
+		idsByPath[artifact.Path] = append(idsByPath[artifact.Path], artifact.ID)
+	}
+
+	var result RetentionResult
+	var errs []error
+	for _, batch := range lo.Chunk(candidates, batchSize) {
+		paths := lo.Uniq(lo.Map(batch, func(a models.Artifact, _ int) string { return a.Path }))
+		shared, err := referencedBlobs(ctx, connectionID, paths, lo.FlatMap(paths, func(p string, _ int) []uuid.UUID { return idsByPath[p] }))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var deleted []models.Artifact
+		for _, artifact := range batch {
+			if shared[artifact.Path] {
+				deleted = append(deleted, artifact)
+				continue
+			}
+			if err := deleteBlob(ctx, fs, artifact.Path); err != nil {
+				errs = append(errs, fmt.Errorf("error deleting artifact(%s): %w", artifact.Path, err))
+				continue
+			}
+			deleted = append(deleted, artifact)
+		}
+
+		if len(deleted) == 0 {
+			continue
+		}
+
+		ids := lo.Map(deleted, func(a models.Artifact, _ int) uuid.UUID { return a.ID })
+		if err := ctx.DB().Model(&models.Artifact{}).Where("id IN ?", ids).UpdateColumn("deleted_at", models.Now()).Error; err != nil {
+			errs = append(errs, fmt.Errorf("error soft deleting artifacts: %w", err))
+			continue
+		}
+
+		bytes := lo.SumBy(deleted, func(a models.Artifact) int64 { return a.Size })
+		result.Deleted += len(deleted)
+		result.BytesReclaimed += bytes
+
+		ctx.Counter("artifacts_retention_deleted_total", "connection", connectionID.String()).Add(len(deleted))
+		ctx.Counter("artifacts_retention_reclaimed_bytes_total", "connection", connectionID.String()).Add(int(bytes))
+	}
+
+	return &result, errors.Join(errs...)
+}
+
+func retentionCandidates(ctx context.Context, connectionID uuid.UUID, policy RetentionPolicy) ([]models.Artifact, error) {
+	conditions := []string{"expires_at < NOW()"}
+	args := []any{connectionID}
+
+	if policy.MaxAge > 0 {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, time.Now().Add(-policy.MaxAge))
+	}
+
+	if policy.MaxCountPerCheck > 0 {
+		conditions = append(conditions, "(check_id IS NOT NULL AND check_rank > ?)")
+		args = append(args, policy.MaxCountPerCheck)
+	}
+
+	if policy.MaxCountPerPlaybookRunAction > 0 {
+		conditions = append(conditions, "(playbook_run_action_id IS NOT NULL AND playbook_rank > ?)")
+		args = append(args, policy.MaxCountPerPlaybookRunAction)
+	}
+
+	if policy.MaxBytes > 0 {
+		conditions = append(conditions, "cumulative_size > ?")
+		args = append(args, policy.MaxBytes)
+	}
+
+	query := fmt.Sprintf(`SELECT * FROM (
+		SELECT artifacts.*,
+			ROW_NUMBER() OVER (PARTITION BY check_id ORDER BY created_at DESC) AS check_rank,
+			ROW_NUMBER() OVER (PARTITION BY playbook_run_action_id ORDER BY created_at DESC) AS playbook_rank,
+			SUM(size) OVER (ORDER BY created_at DESC, id) AS cumulative_size
+		FROM artifacts
+		WHERE connection_id = ? AND deleted_at IS NULL
+	) ranked
+	WHERE %s
+	ORDER BY created_at`, strings.Join(conditions, " OR "))
+
+	var candidates []models.Artifact
+	err := ctx.DB().Raw(query, args...).Scan(&candidates).Error
+	return candidates, err
+}
@@ -0,0 +1,168 @@
+package artifacts
+
+import (
+	gocontext "context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+)
+
+func TestApplyRetention(t *testing.T) {
+	connectionID := uuid.New()
+	checkID := uuid.New()
+	runActionID := uuid.New()
+	now := time.Now().UTC()
+
+	// setup saves the artifacts of the connection, and a stale one of another connection
+	setup := func(t *testing.T) (context.Context, artifactFS.FilesystemRW) {
+		ctx := newTestContext(t)
+		fs := artifactFS.NewLocalFS(t.TempDir())
+
+		for _, artifact := range []models.Artifact{
+			{Path: "check/1.txt", CheckID: &checkID, CreatedAt: now.Add(-3 * time.Hour)},
+			{Path: "check/2.txt", CheckID: &checkID, CreatedAt: now.Add(-2 * time.Hour)},
+			{Path: "check/3.txt", CheckID: &checkID, CreatedAt: now.Add(-time.Hour)},
+			{Path: "playbook/1.txt", PlaybookRunActionID: &runActionID, CreatedAt: now.Add(-5 * time.Hour)},
+			{Path: "playbook/2.txt", PlaybookRunActionID: &runActionID, CreatedAt: now.Add(-4 * time.Hour)},
+			{Path: "stale.txt", CreatedAt: now.Add(-48 * time.Hour)},
+			{Path: "expired.txt", CreatedAt: now.Add(-30 * time.Minute), ExpiresAt: lo.ToPtr(now.Add(-time.Minute))},
+			{Path: "other.txt", ConnectionID: uuid.New(), CreatedAt: now.Add(-48 * time.Hour)},
+		} {
+			if artifact.ConnectionID == uuid.Nil {
+				artifact.ConnectionID = connectionID
+			}
+			if err := SaveArtifact(ctx, fs, &artifact, Artifact{Path: artifact.Path, Content: streamed(artifact.Path), ContentLength: -1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return ctx, fs
+	}
+
+	// remaining returns the paths of the artifacts that were not removed, checking their blobs are kept
+	remaining := func(t *testing.T, ctx context.Context, fs artifactFS.FilesystemRW) []string {
+		var rows []models.Artifact
+		if err := ctx.DB().Where("deleted_at IS NULL").Order("path").Find(&rows).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+		for _, row := range rows {
+			if _, err := fs.Stat(row.Path); err != nil {
+				t.Errorf("expected the blob of %s to be kept, got %v", row.Path, err)
+			}
+			paths = append(paths, row.Path)
+		}
+		return paths
+	}
+
+	for _, tc := range []struct {
+		name     string
+		policy   RetentionPolicy
+		removed  []string
+		expected []string
+	}{
+		{
+			name:     "expired only",
+			removed:  []string{"expired.txt"},
+			expected: []string{"check/1.txt", "check/2.txt", "check/3.txt", "other.txt", "playbook/1.txt", "playbook/2.txt", "stale.txt"},
+		},
+		{
+			name:     "keep last N per check",
+			policy:   RetentionPolicy{MaxCountPerCheck: 2},
+			removed:  []string{"check/1.txt", "expired.txt"},
+			expected: []string{"check/2.txt", "check/3.txt", "other.txt", "playbook/1.txt", "playbook/2.txt", "stale.txt"},
+		},
+		{
+			name:     "keep last N per playbook run action",
+			policy:   RetentionPolicy{MaxCountPerPlaybookRunAction: 1},
+			removed:  []string{"expired.txt", "playbook/1.txt"},
+			expected: []string{"check/1.txt", "check/2.txt", "check/3.txt", "other.txt", "playbook/2.txt", "stale.txt"},
+		},
+		{
+			name:     "max age",
+			policy:   RetentionPolicy{MaxAge: 24 * time.Hour, BatchSize: 1},
+			removed:  []string{"expired.txt", "stale.txt"},
+			expected: []string{"check/1.txt", "check/2.txt", "check/3.txt", "other.txt", "playbook/1.txt", "playbook/2.txt"},
+		},
+		{
+			// newest first: expired.txt 11, check/3.txt 22, check/2.txt 33, check/1.txt 44 bytes, then over the limit
+			name:     "max bytes",
+			policy:   RetentionPolicy{MaxBytes: 44},
+			removed:  []string{"expired.txt", "playbook/1.txt", "playbook/2.txt", "stale.txt"},
+			expected: []string{"check/1.txt", "check/2.txt", "check/3.txt", "other.txt"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, fs := setup(t)
+
+			result, err := ApplyRetention(ctx, connectionID, fs, tc.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Deleted != len(tc.removed) {
+				t.Errorf("expected %d artifacts to be removed, got %d", len(tc.removed), result.Deleted)
+			}
+
+			if paths := remaining(t, ctx, fs); !slices.Equal(paths, tc.expected) {
+				t.Errorf("expected %v to remain, got %v", tc.expected, paths)
+			}
+			for _, p := range tc.removed {
+				if _, err := fs.Stat(p); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("expected the blob of %s to be deleted, got %v", p, err)
+				}
+			}
+		})
+	}
+
+	t.Run("deletes blobs before soft deleting their rows", func(t *testing.T) {
+		ctx, fs := setup(t)
+
+		ordered := &rowCheckingFS{FilesystemRW: fs, t: t, ctx: ctx}
+		if _, err := ApplyRetention(ctx, connectionID, ordered, RetentionPolicy{MaxAge: 24 * time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+		if ordered.deleted != 2 {
+			t.Errorf("expected 2 blobs to be deleted, got %d", ordered.deleted)
+		}
+
+		// a row whose blob could not be deleted is kept, to be retried on the next run
+		result, err := ApplyRetention(ctx, connectionID, undeletableFS{fs}, RetentionPolicy{MaxCountPerCheck: 2})
+		if !errors.Is(err, errDeleteFailed) || result.Deleted != 0 {
+			t.Errorf("expected the failed deletion to be returned and nothing removed, got %+v: %v", result, err)
+		}
+		if paths := remaining(t, ctx, fs); !slices.Contains(paths, "check/1.txt") {
+			t.Errorf("expected the row of check/1.txt to be kept, got %v", paths)
+		}
+	})
+}
+
+// rowCheckingFS checks that the row of every blob it deletes is not soft deleted yet.
+type rowCheckingFS struct {
+	artifactFS.FilesystemRW
+	t       *testing.T
+	ctx     context.Context
+	deleted int
+}
+
+func (t *rowCheckingFS) Delete(ctx gocontext.Context, path string) error {
+	if !IsMetadataPath(path) {
+		var count int64
+		if err := t.ctx.DB().Model(&models.Artifact{}).Where("path = ? AND deleted_at IS NULL", path).Count(&count).Error; err != nil {
+			t.t.Fatal(err)
+		}
+		if count != 1 {
+			t.t.Errorf("expected the row of %s to be kept until its blob is deleted", path)
+		}
+		t.deleted++
+	}
+	return t.FilesystemRW.Delete(ctx, path)
+}
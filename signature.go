@@ -0,0 +1,104 @@
+package artifacts
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("artifact checksum does not match")
+	ErrNotSigned        = errors.New("artifact is not signed")
+	ErrInvalidSignature = errors.New("artifact signature is invalid")
+)
+
+// Signer signs the SHA-256 digest of an artifact's content.
+type Signer interface {
+	// KeyID identifies the key, so verifiers can pick the matching public key.
+	KeyID() string
+	Sign(digest []byte) ([]byte, error)
+}
+
+// Ed25519Signer signs with an Ed25519 private key held in memory.
+type Ed25519Signer struct {
+	id  string
+	key ed25519.PrivateKey
+}
+
+func NewEd25519Signer(keyID string, key ed25519.PrivateKey) *Ed25519Signer {
+	return &Ed25519Signer{id: keyID, key: key}
+}
+
+func (t *Ed25519Signer) KeyID() string {
+	return t.id
+}
+
+func (t *Ed25519Signer) Sign(digest []byte) ([]byte, error) {
+	return ed25519.Sign(t.key, digest), nil
+}
+
+// VerifyArtifact re-reads the artifact through the filesystem and checks that its content
+// still matches the recorded checksums and that its signature is valid for publicKey.
+func VerifyArtifact(ctx context.Context, fs artifactFS.FilesystemRW, artifact *models.Artifact, publicKey ed25519.PublicKey) error {
+	metadata, err := ReadMetadata(ctx, fs, artifact.Path)
+	if err != nil {
+		return fmt.Errorf("error reading metadata of artifact(%s): %w", artifact.Path, err)
+	}
+
+	if metadata.Signature == "" {
+		return ErrNotSigned
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(metadata.Signature)
+	if err != nil {
+		return fmt.Errorf("error decoding signature of artifact(%s): %w", artifact.Path, err)
+	}
+
+	reader, err := ReadArtifact(ctx, fs, artifact)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = reader.Close() }()
+
+	checksum := sha256.New()
+	hashWriters := []io.Writer{checksum}
+	checksums := make(map[ChecksumAlgorithm]hash.Hash, len(metadata.Checksums))
+	for algorithm := range metadata.Checksums {
+		h, err := newChecksum(algorithm)
+		if err != nil {
+			return err
+		}
+		checksums[algorithm] = h
+		hashWriters = append(hashWriters, h)
+	}
+
+	if _, err := io.Copy(io.MultiWriter(hashWriters...), reader); err != nil {
+		return fmt.Errorf("error reading artifact(%s): %w", artifact.Path, err)
+	}
+
+	digest := checksum.Sum(nil)
+	if hex.EncodeToString(digest) != artifact.Checksum {
+		return fmt.Errorf("%w: sha256 of artifact(%s)", ErrChecksumMismatch, artifact.Path)
+	}
+
+	for algorithm, h := range checksums {
+		if hex.EncodeToString(h.Sum(nil)) != metadata.Checksums[algorithm] {
+			return fmt.Errorf("%w: %s of artifact(%s)", ErrChecksumMismatch, algorithm, artifact.Path)
+		}
+	}
+
+	if !ed25519.Verify(publicKey, digest, signature) {
+		return fmt.Errorf("%w: artifact(%s) signed with key %q", ErrInvalidSignature, artifact.Path, metadata.SignatureKeyID)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package artifacts
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+)
+
+func TestVerifyArtifact(t *testing.T) {
+	ctx := newTestContext(t)
+	fs := artifactFS.NewLocalFS(t.TempDir())
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save := func(path string, signer Signer) *models.Artifact {
+		artifact := &models.Artifact{ConnectionID: uuid.New()}
+		err := SaveArtifact(ctx, fs, artifact, Artifact{
+			Path:          path,
+			Content:       streamed("signed content"),
+			ContentLength: -1,
+			Checksums:     []ChecksumAlgorithm{ChecksumCRC32C},
+			Compression:   CompressionGzip,
+			Signer:        signer,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return artifact
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		artifact := save("signed.txt", NewEd25519Signer("key-1", privateKey))
+		if err := VerifyArtifact(ctx, fs, artifact, publicKey); err != nil {
+			t.Errorf("expected the artifact to verify, got %v", err)
+		}
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		artifact := save("other-key.txt", NewEd25519Signer("key-1", privateKey))
+		if err := VerifyArtifact(ctx, fs, artifact, otherKey); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected ErrInvalidSignature, got %v", err)
+		}
+	})
+
+	t.Run("tampered content", func(t *testing.T) {
+		artifact := save("tampered.txt", NewEd25519Signer("key-1", privateKey))
+		metadata, err := ReadMetadata(ctx, fs, artifact.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if metadata.ContentEncoding == "" {
+			t.Fatal("expected the artifact to be compressed")
+		}
+
+		// replace the blob, keeping the sidecar that records it as compressed
+		tampered, err := compress(strings.NewReader("tampered content"), CompressionGzip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tampered.Close()
+		if _, err := fs.Write(ctx, artifact.Path, tampered); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := VerifyArtifact(ctx, fs, artifact, publicKey); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("expected ErrChecksumMismatch, got %v", err)
+		}
+	})
+
+	t.Run("tampered signature", func(t *testing.T) {
+		artifact := save("forged.txt", NewEd25519Signer("key-1", privateKey))
+		metadata, err := ReadMetadata(ctx, fs, artifact.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metadata.Signature = strings.Repeat("A", len(metadata.Signature))
+		if err := writeMetadata(ctx, fs, artifact.Path, *metadata); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := VerifyArtifact(ctx, fs, artifact, publicKey); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected ErrInvalidSignature, got %v", err)
+		}
+	})
+
+	t.Run("not signed", func(t *testing.T) {
+		artifact := save("unsigned.txt", nil)
+		if err := VerifyArtifact(ctx, fs, artifact, publicKey); !errors.Is(err, ErrNotSigned) {
+			t.Errorf("expected ErrNotSigned, got %v", err)
+		}
+	})
+}
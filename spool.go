@@ -0,0 +1,512 @@
+package artifacts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultSpoolInterval   = 30 * time.Second
+	defaultSpoolMaxBackoff = 10 * time.Minute
+
+	// spoolCommitIntervals is how many intervals a spooled artifact without a row is kept for,
+	// as the transaction that saved it may not be committed yet.
+	spoolCommitIntervals = 10
+)
+
+// ErrSpoolFull is returned when an artifact does not fit within SpoolOptions.MaxBytes.
+var ErrSpoolFull = errors.New("spool is full")
+
+// errNotCommitted is returned by upload for an artifact whose row may not be committed yet.
+var errNotCommitted = errors.New("artifact is not committed yet")
+
+type SpoolOptions struct {
+	// Dir is the local directory artifacts are spooled to. It must not be shared by two spools.
+	Dir string
+
+	// MaxBytes is the disk space the spooled artifacts may use. Zero means unlimited.
+	MaxBytes int64
+
+	// Interval is how often the spool is drained, and the delay before the first retry of a failed upload.
+	// Defaults to 30s.
+	Interval time.Duration
+
+	// MaxBackoff caps the delay between the retries of a failed upload, which doubles after every attempt.
+	// Defaults to 10 minutes.
+	MaxBackoff time.Duration
+
+	// OnUpload is called after every attempt to upload a spooled artifact, with a nil error when it succeeded.
+	OnUpload func(entry SpoolEntry, err error)
+}
+
+// SpoolEntry is an artifact that is saved but not yet uploaded to the backend.
+type SpoolEntry struct {
+	ArtifactID uuid.UUID `json:"artifact_id"`
+	Path       string    `json:"path"`
+
+	// Size is the disk space used by the spooled blob and its metadata.
+	Size int64 `json:"size"`
+
+	// Attempts is the number of failed uploads.
+	Attempts    int       `json:"attempts,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Spool saves artifacts to a local directory first and uploads them to the backend in the background,
+// so that artifacts are not lost while the backend is unreachable.
+//
+// The artifact row is inserted as soon as the artifact is spooled, and the pending upload is recorded in the
+// spool directory. Uploads that fail are retried with backoff until they succeed.
+// Pending uploads survive a restart: NewSpool resumes them and removes what a crash left half written.
+//
+// The whole save pipeline runs against the spool, so the uploaded blob is exactly the spooled one.
+// Every artifact is spooled in a directory of its own ID: write modes and content-addressed deduplication
+// find nothing to conflict with there, and the upload always overwrites the backend.
+type Spool struct {
+	ctx     context.Context
+	backend artifactFS.FilesystemRW
+	opts    SpoolOptions
+
+	mu    sync.Mutex
+	usage int64
+
+	// draining serializes Drain, so that an entry is not uploaded twice at once
+	draining sync.Mutex
+
+	// saving are the artifacts whose row may not be committed yet
+	saving map[uuid.UUID]struct{}
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewSpool opens the spool in opts.Dir, recovers it from a previous run and starts uploading
+// to the backend until the spool is closed.
+func NewSpool(ctx context.Context, backend artifactFS.FilesystemRW, opts SpoolOptions) (*Spool, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("spool directory is required")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultSpoolInterval
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultSpoolMaxBackoff
+	}
+
+	for _, dir := range []string{spoolBlobDir(opts.Dir), spoolEntryDir(opts.Dir)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("error creating spool directory: %w", err)
+		}
+	}
+
+	s := &Spool{
+		ctx:     ctx,
+		backend: backend,
+		opts:    opts,
+		saving:  map[uuid.UUID]struct{}{},
+		notify:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := s.recover(); err != nil {
+		return nil, fmt.Errorf("error recovering spool: %w", err)
+	}
+
+	go s.run()
+	return s, nil
+}
+
+func spoolBlobDir(dir string) string {
+	return filepath.Join(dir, "blobs")
+}
+
+func spoolEntryDir(dir string) string {
+	return filepath.Join(dir, "pending")
+}
+
+// spooled returns the spool directory of an artifact, which holds its blob and metadata by the artifact's path.
+func (s *Spool) spooled(id uuid.UUID) artifactFS.FilesystemRW {
+	return artifactFS.NewLocalFS(filepath.Join(spoolBlobDir(s.opts.Dir), id.String()))
+}
+
+// discard removes the spool directory of an artifact.
+func (s *Spool) discard(id uuid.UUID) error {
+	if err := os.RemoveAll(filepath.Join(spoolBlobDir(s.opts.Dir), id.String())); err != nil {
+		return fmt.Errorf("error removing spooled artifact(%s): %w", id, err)
+	}
+	return nil
+}
+
+// SaveArtifact saves the artifact like SaveArtifact, spooling its blob for the backend.
+//
+// It fails with ErrSpoolFull when the artifact does not fit in the spool: upfront if its content length is known,
+// otherwise once spooled.
+//
+// A transaction of ctx must be committed within 10 intervals: until then the upload waits for the row,
+// after that the save is taken as rolled back and the spooled artifact is discarded.
+func (s *Spool) SaveArtifact(ctx context.Context, artifact *models.Artifact, data Artifact) error {
+	if s.opts.MaxBytes > 0 && data.ContentLength > 0 && s.Usage()+data.ContentLength > s.opts.MaxBytes {
+		_ = data.Content.Close()
+		return fmt.Errorf("%w: artifact(%s) of %d bytes", ErrSpoolFull, data.Path, data.ContentLength)
+	}
+
+	if artifact.ID == uuid.Nil {
+		artifact.ID = uuid.New()
+	}
+
+	s.mu.Lock()
+	s.saving[artifact.ID] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.saving, artifact.ID)
+		s.mu.Unlock()
+	}()
+
+	// the directory of a new ID holds no blob to be a duplicate of
+	spooled := s.spooled(artifact.ID)
+	if _, err := storeArtifact(ctx, spooled, artifact, data, noLock{}); err != nil {
+		return errors.Join(err, s.discard(artifact.ID))
+	}
+
+	entry := SpoolEntry{ArtifactID: artifact.ID, Path: artifact.Path, Size: spooledSize(spooled, artifact.Path), CreatedAt: time.Now()}
+	entry.NextAttempt = entry.CreatedAt
+	if err := s.reserve(entry.Size); err != nil {
+		return errors.Join(fmt.Errorf("%w: artifact(%s) of %d bytes", err, artifact.Path, entry.Size), s.discard(artifact.ID))
+	}
+
+	if err := s.writeEntry(entry); err != nil {
+		s.release(entry.Size)
+		return errors.Join(fmt.Errorf("error recording spooled artifact(%s): %w", artifact.Path, err), s.discard(artifact.ID))
+	}
+
+	err := ctx.Transaction(func(ctx context.Context, span trace.Span) error {
+		if err := ctx.DB().Create(artifact).Error; err != nil {
+			return err
+		}
+		return createLabels(ctx, artifact.ID, data.Labels)
+	})
+	if err != nil {
+		_ = s.removeEntry(entry.ArtifactID)
+		s.release(entry.Size)
+		return errors.Join(fmt.Errorf("error saving artifact to db: %w", err), s.discard(artifact.ID))
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ReadArtifact opens the content of an artifact saved through the spool, whether it is uploaded yet or not.
+func (s *Spool) ReadArtifact(ctx context.Context, artifact *models.Artifact) (io.ReadCloser, error) {
+	if _, err := os.Stat(s.entryFile(artifact.ID)); err == nil {
+		if reader, err := ReadArtifact(ctx, s.spooled(artifact.ID), artifact); err == nil {
+			return reader, nil
+		}
+	}
+
+	return ReadArtifact(ctx, s.backend, artifact)
+}
+
+// Usage returns the disk space used by the spooled artifacts.
+func (s *Spool) Usage() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usage
+}
+
+// Pending returns the artifacts that are not uploaded yet, oldest first.
+func (s *Spool) Pending() ([]SpoolEntry, error) {
+	files, err := os.ReadDir(spoolEntryDir(s.opts.Dir))
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool: %w", err)
+	}
+
+	var entries []SpoolEntry
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		entry, err := readSpoolEntry(filepath.Join(spoolEntryDir(s.opts.Dir), file.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			continue // uploaded meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	slices.SortFunc(entries, func(a, b SpoolEntry) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return entries, nil
+}
+
+// Drain uploads every spooled artifact that is due, and returns the number of artifacts still pending.
+// Failed uploads are reported through SpoolOptions.OnUpload and retried later.
+// Concurrent calls wait for each other.
+func (s *Spool) Drain(ctx context.Context) (int, error) {
+	s.draining.Lock()
+	defer s.draining.Unlock()
+
+	entries, err := s.Pending()
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	pending := 0
+	for _, entry := range entries {
+		s.mu.Lock()
+		_, saving := s.saving[entry.ArtifactID]
+		s.mu.Unlock()
+
+		if saving || entry.NextAttempt.After(time.Now()) {
+			pending++
+			continue
+		}
+
+		err := s.upload(ctx, entry)
+		if errors.Is(err, errNotCommitted) {
+			pending++
+			continue
+		}
+		if s.opts.OnUpload != nil {
+			s.opts.OnUpload(entry, err)
+		}
+
+		if err == nil {
+			continue
+		}
+
+		pending++
+		entry.Attempts++
+		entry.LastError = err.Error()
+		entry.NextAttempt = time.Now().Add(s.backoff(entry.Attempts))
+		if err := s.writeEntry(entry); err != nil {
+			errs = append(errs, fmt.Errorf("error recording failed upload of artifact(%s): %w", entry.Path, err))
+		}
+	}
+
+	return pending, errors.Join(errs...)
+}
+
+// upload copies a spooled artifact to the backend and removes it from the spool.
+// Artifacts whose row is still missing after spoolCommitIntervals, e.g. because the save was rolled back,
+// are discarded. Until then upload fails with errNotCommitted.
+func (s *Spool) upload(ctx context.Context, entry SpoolEntry) error {
+	var count int64
+	if err := ctx.DB().Model(&models.Artifact{}).Where("id = ? AND deleted_at IS NULL", entry.ArtifactID).Count(&count).Error; err != nil {
+		return fmt.Errorf("error getting artifact(%s): %w", entry.ArtifactID, err)
+	}
+
+	if count == 0 && time.Since(entry.CreatedAt) < spoolCommitIntervals*s.opts.Interval {
+		return errNotCommitted
+	}
+
+	if count > 0 {
+		spooled := s.spooled(entry.ArtifactID)
+
+		// the metadata goes first, so that an uploaded blob always comes with it
+		for _, p := range []string{metadataPath(entry.Path), entry.Path} {
+			if err := copyBlobFile(ctx, spooled, s.backend, p, p); err != nil {
+				if p != entry.Path && errors.Is(err, os.ErrNotExist) {
+					continue // the artifact has no metadata
+				}
+				return err
+			}
+		}
+	}
+
+	if err := s.discard(entry.ArtifactID); err != nil {
+		return err
+	}
+	if err := s.removeEntry(entry.ArtifactID); err != nil {
+		return fmt.Errorf("error removing spooled artifact(%s): %w", entry.Path, err)
+	}
+	s.release(entry.Size)
+	return nil
+}
+
+func (s *Spool) backoff(attempts int) time.Duration {
+	delay := s.opts.Interval
+	for range attempts - 1 {
+		if delay *= 2; delay >= s.opts.MaxBackoff {
+			return s.opts.MaxBackoff
+		}
+	}
+	return min(delay, s.opts.MaxBackoff)
+}
+
+// recover restores the disk usage of the pending uploads and removes the blobs and entries
+// a crash left behind while spooling.
+func (s *Spool) recover() error {
+	entries, err := s.Pending()
+	if err != nil {
+		return err
+	}
+
+	spooled := map[string]struct{}{}
+	for _, entry := range entries {
+		s.usage += entry.Size
+		spooled[entry.ArtifactID.String()] = struct{}{}
+	}
+
+	// the directories of artifacts that were being spooled, or whose upload was being completed
+	dirs, err := os.ReadDir(spoolBlobDir(s.opts.Dir))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if _, ok := spooled[dir.Name()]; !ok {
+			if err := os.RemoveAll(filepath.Join(spoolBlobDir(s.opts.Dir), dir.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	// entries that were being written when the process stopped
+	temps, err := filepath.Glob(filepath.Join(spoolEntryDir(s.opts.Dir), ".entry-*"))
+	if err != nil {
+		return err
+	}
+	for _, temp := range temps {
+		if err := os.Remove(temp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// spooledSize returns the disk space used by a spooled blob and its metadata.
+func spooledSize(spooled artifactFS.FilesystemRW, artifactPath string) int64 {
+	var size int64
+	for _, p := range []string{artifactPath, metadataPath(artifactPath)} {
+		if info, err := spooled.Stat(p); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func (s *Spool) reserve(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.opts.MaxBytes > 0 && s.usage+size > s.opts.MaxBytes {
+		return ErrSpoolFull
+	}
+	s.usage += size
+	return nil
+}
+
+func (s *Spool) release(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage = max(s.usage-size, 0)
+}
+
+func (s *Spool) entryFile(id uuid.UUID) string {
+	return filepath.Join(spoolEntryDir(s.opts.Dir), id.String()+".json")
+}
+
+// writeEntry records an entry, replacing the file atomically so that a crash never leaves it half written.
+func (s *Spool) writeEntry(entry SpoolEntry) error {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(spoolEntryDir(s.opts.Dir), ".entry-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(temp.Name()) }()
+
+	if _, err := temp.Write(content); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), s.entryFile(entry.ArtifactID))
+}
+
+func (s *Spool) removeEntry(id uuid.UUID) error {
+	if err := os.Remove(s.entryFile(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func readSpoolEntry(file string) (SpoolEntry, error) {
+	var entry SpoolEntry
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return entry, fmt.Errorf("error reading spool entry %s: %w", file, err)
+	}
+
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return entry, fmt.Errorf("error parsing spool entry %s: %w", file, err)
+	}
+	return entry, nil
+}
+
+// run drains the spool until it is closed.
+func (s *Spool) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		_, _ = s.Drain(s.ctx)
+
+		select {
+		case <-s.stop:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.notify:
+		}
+	}
+}
+
+// Close stops uploading. Pending artifacts stay in the spool and are uploaded once it is opened again.
+// The backend is not closed.
+func (s *Spool) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+	return nil
+}
@@ -0,0 +1,257 @@
+package artifacts
+
+import (
+	gocontext "context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	artifactFS "github.com/flanksource/artifacts/fs"
+	"github.com/flanksource/duty/context"
+	"github.com/flanksource/duty/models"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// unreachableFS fails every write as if the backend could not be reached while it is down.
+type unreachableFS struct {
+	artifactFS.FilesystemRW
+	down atomic.Bool
+}
+
+func (t *unreachableFS) Write(ctx gocontext.Context, path string, data io.Reader) (os.FileInfo, error) {
+	if t.down.Load() {
+		return nil, syscall.ECONNREFUSED
+	}
+	return t.FilesystemRW.Write(ctx, path, data)
+}
+
+// waitFor polls until condition holds.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func pending(t *testing.T, spool *Spool) []SpoolEntry {
+	t.Helper()
+	entries, err := spool.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestSpoolUnreachableBackend(t *testing.T) {
+	ctx := newTestContext(t)
+	backend := &unreachableFS{FilesystemRW: artifactFS.NewLocalFS(t.TempDir())}
+	backend.down.Store(true)
+
+	var failed atomic.Int32
+	spool, err := NewSpool(ctx, backend, SpoolOptions{
+		Dir:        t.TempDir(),
+		Interval:   10 * time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		OnUpload: func(entry SpoolEntry, err error) {
+			if err != nil {
+				failed.Add(1)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	// two artifacts of the same path are spooled apart
+	first, second := &models.Artifact{ConnectionID: uuid.New()}, &models.Artifact{ConnectionID: uuid.New()}
+	for i, artifact := range []*models.Artifact{first, second} {
+		if err := spool.SaveArtifact(ctx, artifact, Artifact{Path: "report.txt", Content: streamed(strings.Repeat("a", i+1)), ContentLength: -1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, func() bool { return failed.Load() > 0 })
+	if entries := pending(t, spool); len(entries) != 2 {
+		t.Fatalf("expected 2 pending uploads, got %+v", entries)
+	}
+	if content := readSpooled(t, ctx, spool, first); content != "a" {
+		t.Errorf("expected the spooled content of the first artifact, got %q", content)
+	}
+	if content := readSpooled(t, ctx, spool, second); content != "aa" {
+		t.Errorf("expected the spooled content of the second artifact, got %q", content)
+	}
+
+	backend.down.Store(false)
+	waitFor(t, func() bool { return len(pending(t, spool)) == 0 && spool.Usage() == 0 })
+
+	// the uploads of the same path overwrite each other
+	if content := readContent(t, ctx, backend, second); content != "a" && content != "aa" {
+		t.Errorf("expected the artifact to be uploaded, got %q", content)
+	}
+}
+
+func readSpooled(t *testing.T, ctx context.Context, spool *Spool, artifact *models.Artifact) string {
+	t.Helper()
+	reader, err := spool.ReadArtifact(ctx, artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestSpoolRecovery(t *testing.T) {
+	ctx := newTestContext(t)
+	dir := t.TempDir()
+	backend := &unreachableFS{FilesystemRW: artifactFS.NewLocalFS(t.TempDir())}
+	backend.down.Store(true)
+
+	opts := SpoolOptions{Dir: dir, Interval: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	spool, err := NewSpool(ctx, backend, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifact := &models.Artifact{ConnectionID: uuid.New()}
+	if err := spool.SaveArtifact(ctx, artifact, Artifact{Path: "kept.txt", Content: streamed("kept"), ContentLength: -1}); err != nil {
+		t.Fatal(err)
+	}
+	usage := spool.Usage()
+	_ = spool.Close()
+
+	// what a crash leaves behind: the blob of an artifact without an entry, and a half written entry
+	orphan := filepath.Join(spoolBlobDir(dir), uuid.NewString())
+	if err := os.MkdirAll(orphan, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(orphan, "orphan.txt"), []byte("orphan"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	halfWritten := filepath.Join(spoolEntryDir(dir), ".entry-123")
+	if err := os.WriteFile(halfWritten, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err = NewSpool(ctx, backend, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	if _, err := os.Stat(orphan); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the orphan blob to be removed, got %v", err)
+	}
+	if _, err := os.Stat(halfWritten); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the half written entry to be removed, got %v", err)
+	}
+	if spool.Usage() != usage {
+		t.Errorf("expected the usage of the pending upload to be restored, got %d instead of %d", spool.Usage(), usage)
+	}
+
+	backend.down.Store(false)
+	waitFor(t, func() bool { return len(pending(t, spool)) == 0 })
+	if content := readContent(t, ctx, backend, artifact); content != "kept" {
+		t.Errorf("expected the recovered artifact to be uploaded, got %q", content)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	ctx := newTestContext(t)
+	dir := t.TempDir()
+	spool, err := NewSpool(ctx, artifactFS.NewLocalFS(t.TempDir()), SpoolOptions{Dir: dir, MaxBytes: 64, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	content := strings.Repeat("a", 128)
+	err = spool.SaveArtifact(ctx, &models.Artifact{ConnectionID: uuid.New()}, Artifact{Path: "known.txt", Content: streamed(content), ContentLength: int64(len(content))})
+	if !errors.Is(err, ErrSpoolFull) {
+		t.Errorf("expected an artifact of known length to be rejected upfront, got %v", err)
+	}
+
+	err = spool.SaveArtifact(ctx, &models.Artifact{ConnectionID: uuid.New()}, Artifact{Path: "unknown.txt", Content: streamed(content), ContentLength: -1})
+	if !errors.Is(err, ErrSpoolFull) {
+		t.Errorf("expected an artifact of unknown length to be rejected once spooled, got %v", err)
+	}
+
+	if blobs, _ := os.ReadDir(spoolBlobDir(dir)); len(blobs) != 0 {
+		t.Errorf("expected the rejected artifacts to be removed from the spool, got %d", len(blobs))
+	}
+	var count int64
+	if err := ctx.DB().Model(&models.Artifact{}).Count(&count).Error; err != nil || count != 0 {
+		t.Errorf("expected no artifact rows, got %d: %v", count, err)
+	}
+}
+
+func TestSpoolRolledBack(t *testing.T) {
+	ctx := newTestContext(t)
+	backend := artifactFS.NewLocalFS(t.TempDir())
+	spool, err := NewSpool(ctx, backend, SpoolOptions{Dir: t.TempDir(), Interval: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	errRollback := errors.New("rollback")
+	err = ctx.Transaction(func(ctx context.Context, _ trace.Span) error {
+		if err := spool.SaveArtifact(ctx, &models.Artifact{ConnectionID: uuid.New()}, Artifact{Path: "rolled-back.txt", Content: streamed("content"), ContentLength: -1}); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("expected the transaction to be rolled back, got %v", err)
+	}
+
+	// the artifact is discarded once its row is still missing after the grace period
+	waitFor(t, func() bool { return len(pending(t, spool)) == 0 && spool.Usage() == 0 })
+	if _, err := backend.Stat("rolled-back.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the rolled back artifact to be discarded, got %v", err)
+	}
+}
+
+func TestSpoolUncommitted(t *testing.T) {
+	ctx := newTestContext(t)
+	backend := artifactFS.NewLocalFS(t.TempDir())
+	spool, err := NewSpool(ctx, backend, SpoolOptions{Dir: t.TempDir(), Interval: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	artifact := &models.Artifact{ConnectionID: uuid.New()}
+	err = ctx.Transaction(func(tx context.Context, _ trace.Span) error {
+		if err := spool.SaveArtifact(tx, artifact, Artifact{Path: "uncommitted.txt", Content: streamed("content"), ContentLength: -1}); err != nil {
+			return err
+		}
+
+		// the spool drains outside of the transaction, where the row is not visible yet
+		if remaining, err := spool.Drain(ctx); err != nil || remaining != 1 {
+			t.Errorf("expected the uncommitted artifact to stay pending, got %d pending: %v", remaining, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return len(pending(t, spool)) == 0 && spool.Usage() == 0 })
+	if content := readContent(t, ctx, backend, artifact); content != "content" {
+		t.Errorf("expected the committed artifact to be uploaded, got %q", content)
+	}
+}
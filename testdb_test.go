@@ -0,0 +1,75 @@
+package artifacts
+
+import (
+	"database/sql/driver"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flanksource/duty/context"
+	"github.com/glebarez/go-sqlite"
+	gormSqlite "github.com/glebarez/sqlite"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// artifactsTable mirrors the artifacts table of duty's schema.
+const artifactsTable = `CREATE TABLE artifacts (
+	id TEXT PRIMARY KEY DEFAULT (generate_ulid()),
+	check_id TEXT,
+	check_time DATETIME,
+	playbook_run_action_id TEXT,
+	connection_id TEXT,
+	path TEXT NOT NULL,
+	is_pushed BOOLEAN NOT NULL DEFAULT false,
+	is_data_pushed BOOLEAN NOT NULL DEFAULT false,
+	filename TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	content_type TEXT,
+	checksum TEXT NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT (NOW()),
+	updated_at DATETIME NOT NULL DEFAULT (NOW()),
+	deleted_at DATETIME,
+	expires_at DATETIME
+)`
+
+// sqliteTimeFormat is the format times are stored in by the driver, so that they compare as text.
+const sqliteTimeFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+var registerTestDBFunctions = sync.OnceFunc(func() {
+	// the postgres functions the queries and the schema rely on
+	sqlite.MustRegisterScalarFunction("now", 0, func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+		return time.Now().UTC().Format(sqliteTimeFormat), nil
+	})
+	sqlite.MustRegisterScalarFunction("generate_ulid", 0, func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+		return uuid.New().String(), nil
+	})
+})
+
+// newTestContext returns a context with a database of its own, holding empty artifacts and artifact_labels tables.
+func newTestContext(t *testing.T) context.Context {
+	t.Helper()
+	registerTestDBFunctions()
+
+	db, err := gorm.Open(gormSqlite.Open(filepath.Join(t.TempDir(), "artifacts.db")), &gorm.Config{
+		Logger:  logger.Discard,
+		NowFunc: func() time.Time { return time.Now().UTC() },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(artifactsTable).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { _ = sqlDB.Close() })
+
+	ctx := context.New().WithDB(db, nil)
+	if err := MigrateArtifactLabels(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}